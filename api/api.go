@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/soluto/dqd/api/health"
@@ -11,10 +12,15 @@ import (
 	v1 "github.com/soluto/dqd/v1"
 )
 
-func Start(ctx context.Context, port int, healthChecker v1.HealthChecker) error {
+func Start(ctx context.Context, port int, healthChecker v1.HealthChecker, livenessChecker v1.HealthChecker) error {
+	history := health.NewHistory()
+	go history.Watch(ctx.Done(), healthChecker, 5*time.Second)
+
 	router := httprouter.New()
 	router.GET("/metrics", metrics.CreateMetricsHandler())
-	router.GET("/health", health.CreateHealthHandler(healthChecker))
+	router.GET("/health", health.CreateHealthHandler(healthChecker, history))
+	router.GET("/ready", health.CreateReadyHandler(healthChecker))
+	router.GET("/live", health.CreateLiveHandler(livenessChecker))
 	srv := &http.Server{Addr: fmt.Sprintf(":%v", port)}
 	e := make(chan error, 1)
 	go func() {
@@ -3,17 +3,113 @@ package health
 import (
 	"encoding/json"
 	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	v1 "github.com/soluto/dqd/v1"
 )
 
-func CreateHealthHandler(healthChecker v1.HealthChecker) httprouter.Handle {
+const errorPrefix = "Error - "
+
+type Entry struct {
+	Status string    `json:"status"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// History keeps the time every health entry changed to its current status.
+type History struct {
+	lock    sync.Mutex
+	entries map[string]*Entry
+}
+
+func NewHistory() *History {
+	return &History{
+		entries: map[string]*Entry{},
+	}
+}
+
+// Observe records the status and returns the current entries, keyed by pipe, source, output and handler.
+func (h *History) Observe(s v1.HealthStatus) map[string]Entry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	result := map[string]Entry{}
+	for k, v := range s {
+		status, reason := string(v), ""
+		if strings.HasPrefix(status, errorPrefix) {
+			status, reason = "Error", strings.TrimPrefix(status, errorPrefix)
+		}
+		key := strings.TrimSuffix(k, ".")
+		e, ok := h.entries[key]
+		if !ok || e.Status != status || e.Reason != reason {
+			e = &Entry{status, reason, now}
+			h.entries[key] = e
+		}
+		result[key] = *e
+	}
+	for k := range h.entries {
+		if _, ok := result[k]; !ok {
+			delete(h.entries, k)
+		}
+	}
+	return result
+}
+
+// Watch observes the status every interval so change times are kept between requests.
+func (h *History) Watch(done <-chan struct{}, healthChecker v1.HealthChecker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.Observe(healthChecker.HealthStatus())
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func CreateHealthHandler(healthChecker v1.HealthChecker, history *History) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		s := healthChecker.HealthStatus()
+		entries := history.Observe(s)
 		if !s.IsHealthy() {
 			w.WriteHeader(500)
 		}
+		if _, verbose := r.URL.Query()["verbose"]; verbose {
+			json.NewEncoder(w).Encode(entries)
+			return
+		}
 		json.NewEncoder(w).Encode(s)
 	}
 }
+
+// CreateReadyHandler responds with 500 until the handlers and sources of all pipes are healthy.
+func CreateReadyHandler(healthChecker v1.HealthChecker) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if !healthChecker.HealthStatus().IsHealthy() {
+			w.WriteHeader(500)
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.Write([]byte("ready"))
+	}
+}
+
+// CreateLiveHandler responds with 500 when a pipe stopped, it doesn't depend on handlers or sources.
+func CreateLiveHandler(livenessChecker v1.HealthChecker) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		s := livenessChecker.HealthStatus()
+		if !s.IsHealthy() {
+			w.WriteHeader(500)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Pipes      v1.HealthStatus `json:"pipes"`
+			Goroutines int             `json:"goroutines"`
+		}{s, runtime.NumGoroutine()})
+	}
+}
@@ -0,0 +1,39 @@
+package health
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/soluto/dqd/health"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func TestReadyFollowsRegisteredCheckers(t *testing.T) {
+	var healthy atomic.Value
+	healthy.Store(false)
+	handler := v1.HealthCheckerFunc(func() v1.HealthStatus {
+		if healthy.Load().(bool) {
+			return v1.NewHealthStatus(v1.Healthy)
+		}
+		return v1.NewHealthStatus(v1.Error(errors.New("connection refused")))
+	})
+	probe := health.MakeProbe()
+	probe.Register(handler, "handler")
+	ready := CreateReadyHandler(probe)
+
+	expect := func(code int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ready(rec, httptest.NewRequest("GET", "/ready", nil), nil)
+		if rec.Code != code {
+			t.Fatalf("expected %v, got %v", code, rec.Code)
+		}
+	}
+	expect(500)
+	healthy.Store(true)
+	expect(200)
+	healthy.Store(false)
+	expect(500)
+}
@@ -15,6 +15,12 @@ func CreateMetricsHandler() httprouter.Handle {
 		metrics.PipeProcessingMessagesHistogram,
 		metrics.WorkerBatchSizeGauge,
 		metrics.WorkerMaxConcurrencyGauge,
+		metrics.WorkerInflightGauge,
+		metrics.WorkerQueueingDelayHistogram,
+		metrics.WorkerThrottledTimeCounter,
+		metrics.WorkerFilteredCounter,
+		metrics.WorkerRoutedCounter,
+		metrics.WorkerDuplicatesCounter,
 	)
 	handler := promhttp.Handler()
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
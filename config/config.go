@@ -2,15 +2,22 @@ package config
 
 import (
 	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/soluto/dqd/dedup"
 	"github.com/soluto/dqd/handlers"
 	"github.com/soluto/dqd/listeners"
 	"github.com/soluto/dqd/pipe"
 	"github.com/soluto/dqd/providers/azure"
 	"github.com/soluto/dqd/providers/servicebus"
 	"github.com/soluto/dqd/providers/sqs"
+	"github.com/soluto/dqd/transform"
 	"github.com/soluto/dqd/utils"
 	v1 "github.com/soluto/dqd/v1"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
@@ -63,6 +70,23 @@ func getSource(sources map[string]*v1.Source, sourceName string) *v1.Source {
 	return source
 }
 
+func isPipeSource(pipeSources []*v1.Source, name string) bool {
+	for _, s := range pipeSources {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// throughputLimit validates a rate perSecond, a rate limiter with no rate would never let messages through.
+func throughputLimit(perSecond float64, pipeName string) float64 {
+	if perSecond <= 0 {
+		panic(fmt.Sprintf("Invalid rate perSecond of pipe %v, expected a positive number: %v", pipeName, perSecond))
+	}
+	return perSecond
+}
+
 func getPipeSources(sources map[string]*v1.Source, v *viper.Viper) (pipeSources []*v1.Source) {
 	sourcesConfig := v.GetStringSlice("sources")
 	for _, s := range sourcesConfig {
@@ -81,6 +105,12 @@ func createHandler(v *viper.Viper) handlers.Handler {
 	if v.Get("none") != nil {
 		return handlers.None
 	}
+	if v.Get("grpc") != nil {
+		return createGrpcHandler(v)
+	}
+	if v.Get("command") != nil {
+		return createCommandHandler(v)
+	}
 	v.SetDefault("http.path", "/")
 	v.SetDefault("http.host", "localhost")
 	v.SetDefault("http.port", 80)
@@ -103,6 +133,348 @@ func createHandler(v *viper.Viper) handlers.Handler {
 	return handlers.NewHttpHandler(options)
 }
 
+func createGrpcHandler(v *viper.Viper) handlers.Handler {
+	v.SetDefault("grpc.host", "localhost")
+	v.SetDefault("grpc.port", 50051)
+	v.SetDefault("grpc.timeout", "2m")
+	v.SetDefault("grpc.tls", false)
+	v.SetDefault("grpc.healthService", "")
+	v.SetDefault("grpc.metadata", map[string]string{})
+
+	address := v.GetString("grpc.address")
+	if address == "" {
+		address = fmt.Sprintf("%v:%v", v.GetString("grpc.host"), v.GetString("grpc.port"))
+	}
+	method := v.GetString("grpc.method")
+	if method == "" {
+		panic("Missing grpc handler method")
+	}
+
+	return handlers.NewGrpcHandler(&handlers.GrpcHandlerOptions{
+		Address:       address,
+		Method:        method,
+		HealthService: v.GetString("grpc.healthService"),
+		Timeout:       v.GetDuration("grpc.timeout"),
+		TLS:           v.GetBool("grpc.tls"),
+		Metadata:      v.GetStringMapString("grpc.metadata"),
+	})
+}
+
+func createCommandHandler(v *viper.Viper) handlers.Handler {
+	v.SetDefault("command.args", []string{})
+	v.SetDefault("command.env", map[string]string{})
+	v.SetDefault("command.persistent", false)
+	v.SetDefault("command.timeout", "2m")
+
+	path := v.GetString("command.path")
+	if path == "" {
+		panic("Missing command handler path")
+	}
+
+	return handlers.NewCommandHandler(&handlers.CommandHandlerOptions{
+		Path:       path,
+		Args:       v.GetStringSlice("command.args"),
+		Env:        v.GetStringMapString("command.env"),
+		Persistent: v.GetBool("command.persistent"),
+		Timeout:    v.GetDuration("command.timeout"),
+	})
+}
+
+func createRetryPolicy(v *viper.Viper) *pipe.RetryPolicy {
+	v.SetDefault("maxAttempts", 3)
+	v.SetDefault("mode", string(pipe.RetryRedeliver))
+	v.SetDefault("backoff.type", "exponential")
+	v.SetDefault("backoff.min", "1s")
+	v.SetDefault("backoff.max", "5m")
+	v.SetDefault("backoff.factor", 2)
+	v.SetDefault("backoff.jitter", false)
+	v.SetDefault("retryOn", []int{5})
+
+	mode := pipe.RetryMode(v.GetString("mode"))
+	if mode != pipe.RetryInProcess && mode != pipe.RetryRedeliver {
+		panic(fmt.Sprintf("Unknown retry mode: %v", mode))
+	}
+
+	policy := &pipe.RetryPolicy{
+		MaxAttempts: v.GetInt("maxAttempts"),
+		Mode:        mode,
+	}
+	policy.Backoff.Min = v.GetDuration("backoff.min")
+	policy.Backoff.Max = v.GetDuration("backoff.max")
+	policy.Backoff.Factor = v.GetFloat64("backoff.factor")
+	policy.Backoff.Jitter = v.GetBool("backoff.jitter")
+	switch backoffType := v.GetString("backoff.type"); backoffType {
+	case "exponential":
+	case "fixed":
+		policy.Backoff.Factor = 1
+		policy.Backoff.Max = policy.Backoff.Min
+	default:
+		panic(fmt.Sprintf("Unknown retry backoff type: %v", backoffType))
+	}
+	for _, code := range v.GetIntSlice("retryOn") {
+		policy.RetryOn = append(policy.RetryOn, handlers.HandlerErrorCode(code))
+	}
+	return policy
+}
+
+func createLimiter(v *viper.Viper) pipe.WorkerOption {
+	if v.IsSet("rate.fixed") {
+		return pipe.WithFixedRate(v.GetInt("rate.fixed"))
+	}
+	init, min, max := v.GetInt("rate.init"), v.GetInt("rate.min"), v.GetInt("rate.max")
+	window := v.GetDuration("rate.window")
+	switch limiter := v.GetString("rate.limiter"); limiter {
+	case "hillClimb":
+		return pipe.WithLimiter(pipe.NewHillClimbLimiter(init, min, max), window)
+	case "aimd":
+		return pipe.WithLimiter(pipe.NewAIMDLimiter(init, min, max, v.GetFloat64("rate.backoffRatio")), window)
+	case "gradient":
+		return pipe.WithLimiter(pipe.NewGradientLimiter(init, min, max, v.GetFloat64("rate.smoothing"), v.GetFloat64("rate.tolerance")), window)
+	case "fixed":
+		return pipe.WithFixedRate(init)
+	default:
+		panic(fmt.Sprintf("Unknown rate limiter: %v", limiter))
+	}
+}
+
+// stringList reads a config value given as a scalar or a list.
+func stringList(value interface{}) []string {
+	if value == nil {
+		return nil
+	}
+	if reflect.TypeOf(value).Kind() == reflect.Slice {
+		return cast.ToStringSlice(value)
+	}
+	return []string{cast.ToString(value)}
+}
+
+// createConditions reads the conditions and whether any of them should match instead of all of them.
+func createConditions(v *viper.Viper) (conditions []*pipe.Condition, any bool) {
+	v.SetDefault("match", "all")
+	switch v.GetString("match") {
+	case "all":
+	case "any":
+		any = true
+	default:
+		panic(fmt.Sprintf("Unknown conditions match: %v", v.GetString("match")))
+	}
+
+	for _, conditionConfig := range utils.ViperSubSlice(v, "conditions") {
+		key, err := utils.ParseKeyExpression(conditionConfig.GetString("key"))
+		if err != nil {
+			panic(fmt.Sprintf("Invalid condition: %v", err))
+		}
+		condition := &pipe.Condition{
+			Key:   key,
+			In:    append(stringList(conditionConfig.Get("equals")), stringList(conditionConfig.Get("in"))...),
+			NotIn: stringList(conditionConfig.Get("notIn")),
+		}
+		if conditionConfig.IsSet("exists") {
+			exists := conditionConfig.GetBool("exists")
+			condition.Exists = &exists
+		}
+		if pattern := conditionConfig.GetString("matches"); pattern != "" {
+			condition.Matches = regexp.MustCompile(pattern)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, any
+}
+
+func createFilter(v *viper.Viper, sources map[string]*v1.Source) *pipe.Filter {
+	v.SetDefault("onMismatch", string(pipe.FilterComplete))
+	filter := &pipe.Filter{
+		OnMismatch: pipe.FilterAction(v.GetString("onMismatch")),
+	}
+	filter.Conditions, filter.Any = createConditions(v)
+	switch filter.OnMismatch {
+	case pipe.FilterComplete, pipe.FilterSkip:
+	case pipe.FilterRoute:
+		filter.Source = getSource(sources, v.GetString("source"))
+	default:
+		panic(fmt.Sprintf("Unknown filter onMismatch action: %v", filter.OnMismatch))
+	}
+	return filter
+}
+
+// createTransform reads a list of steps, steps without arguments are given by name and other steps as a single key map.
+func createTransform(steps interface{}) (pipeline transform.Pipeline) {
+	for _, s := range cast.ToSlice(steps) {
+		name, arg := cast.ToString(s), ""
+		if m := cast.ToStringMapString(s); len(m) > 0 {
+			if len(m) != 1 {
+				panic(fmt.Sprintf("Invalid transform step: %v", s))
+			}
+			for name, arg = range m {
+			}
+		}
+		switch name {
+		case "extract":
+			pipeline = append(pipeline, transform.Extract(arg))
+		case "template":
+			step, err := transform.Template(arg)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid transform template: %v", err))
+			}
+			pipeline = append(pipeline, step)
+		case "base64Decode":
+			pipeline = append(pipeline, transform.Base64Decode())
+		case "base64Encode":
+			pipeline = append(pipeline, transform.Base64Encode())
+		case "unwrapSns":
+			pipeline = append(pipeline, transform.UnwrapSns())
+		case "trimSerializationInfo":
+			pipeline = append(pipeline, transform.TrimSerializationInfo())
+		default:
+			panic(fmt.Sprintf("Unknown transform step: %v", name))
+		}
+	}
+	return pipeline
+}
+
+func createRouter(v *viper.Viper, sources map[string]*v1.Source) *pipe.Router {
+	v.SetDefault("mode", string(pipe.RouterFirst))
+	router := &pipe.Router{
+		Mode: pipe.RouterMode(v.GetString("mode")),
+	}
+	if router.Mode != pipe.RouterFirst && router.Mode != pipe.RouterBroadcast {
+		panic(fmt.Sprintf("Unknown router mode: %v", router.Mode))
+	}
+	for _, ruleConfig := range utils.ViperSubSlice(v, "rules") {
+		rule := &pipe.RouterRule{}
+		rule.Conditions, rule.Any = createConditions(ruleConfig)
+		for _, d := range cast.ToSlice(ruleConfig.Get("destinations")) {
+			destination := &pipe.Destination{OnFailure: pipe.DestinationIgnore}
+			if name, ok := d.(string); ok {
+				destination.Source = getSource(sources, name)
+			} else {
+				m := cast.ToStringMapString(d)
+				destination.Source = getSource(sources, m["source"])
+				if onFailure, ok := m["onFailure"]; ok {
+					destination.OnFailure = pipe.DestinationFailure(onFailure)
+				}
+			}
+			if destination.OnFailure != pipe.DestinationIgnore && destination.OnFailure != pipe.DestinationFail {
+				panic(fmt.Sprintf("Unknown router destination onFailure: %v", destination.OnFailure))
+			}
+			rule.Destinations = append(rule.Destinations, destination)
+		}
+		if len(rule.Destinations) == 0 {
+			panic("Missing router rule destinations")
+		}
+		router.Rules = append(router.Rules, rule)
+	}
+	return router
+}
+
+func createAggregate(v *viper.Viper) *pipe.Aggregate {
+	v.SetDefault("size", 100)
+	v.SetDefault("window", "5s")
+	aggregate := &pipe.Aggregate{
+		Size:   v.GetInt("size"),
+		Window: v.GetDuration("window"),
+	}
+	if aggregate.Window <= 0 {
+		panic(fmt.Sprintf("Invalid aggregate window: %v", aggregate.Window))
+	}
+	if by := v.GetString("by"); by != "" {
+		key, err := utils.ParseKeyExpression(by)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid aggregate key: %v", err))
+		}
+		aggregate.Key = key
+	}
+	return aggregate
+}
+
+func createDeduplication(v *viper.Viper, pipeName string) *pipe.Deduplication {
+	v.SetDefault("key", "id")
+	v.SetDefault("ttl", "1h")
+	v.SetDefault("reserveTtl", "10m")
+	v.SetDefault("timeout", "1s")
+	v.SetDefault("store.type", "memory")
+	v.SetDefault("store.size", 10000)
+	v.SetDefault("store.path", "dqd-dedup.db")
+	v.SetDefault("store.address", "localhost:6379")
+	v.SetDefault("store.timeout", "1s")
+	v.SetDefault("store.poolSize", 10)
+	v.SetDefault("store.prefix", "dqd:"+pipeName+":")
+
+	d := &pipe.Deduplication{
+		TTL:        v.GetDuration("ttl"),
+		ReserveTTL: v.GetDuration("reserveTtl"),
+		Timeout:    v.GetDuration("timeout"),
+	}
+	if d.TTL <= 0 {
+		panic(fmt.Sprintf("Invalid dedup ttl: %v, must be positive", v.GetString("ttl")))
+	}
+	if d.ReserveTTL <= 0 {
+		panic(fmt.Sprintf("Invalid dedup reserveTtl: %v, must be positive", v.GetString("reserveTtl")))
+	}
+	if key := v.GetString("key"); key != "id" {
+		expression, err := utils.ParseKeyExpression(key)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid dedup key: %v", err))
+		}
+		d.Key = expression
+	}
+
+	switch storeType := v.GetString("store.type"); storeType {
+	case "memory":
+		size := v.GetInt("store.size")
+		if size <= 0 {
+			panic(fmt.Sprintf("Invalid dedup store size: %v, must be positive", size))
+		}
+		d.Store = dedup.NewMemoryStore(size)
+	case "bolt":
+		store, err := dedup.NewBoltStore(v.GetString("store.path"), pipeName, d.TTL)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to open dedup store %v: %v", v.GetString("store.path"), err))
+		}
+		d.Store = store
+	case "redis":
+		d.Store = dedup.NewRedisStore(&dedup.RedisOptions{
+			Address:  v.GetString("store.address"),
+			Password: v.GetString("store.password"),
+			DB:       v.GetInt("store.db"),
+			Prefix:   v.GetString("store.prefix"),
+			Timeout:  v.GetDuration("store.timeout"),
+			PoolSize: v.GetInt("store.poolSize"),
+		})
+	default:
+		panic(fmt.Sprintf("Unknown dedup store: %v", storeType))
+	}
+	return d
+}
+
+func createRoutes(v *viper.Viper, sources map[string]*v1.Source) (opts []pipe.WorkerOption) {
+	for _, routeConfig := range utils.ViperSubSlice(v, "routes") {
+		routeConfig.SetDefault("action", string(pipe.RouteComplete))
+		status := routeConfig.Get("status")
+		if status == nil {
+			panic("Missing route status")
+		}
+		route := &pipe.Route{
+			Statuses: stringList(status),
+			Action:   pipe.RouteAction(routeConfig.GetString("action")),
+		}
+		switch route.Action {
+		case pipe.RouteComplete, pipe.RouteRetry, pipe.RouteDrop:
+		case pipe.RouteDeadLetter:
+			if routeConfig.GetString("source") == "" && v.GetString("onError.writeTo.source") == "" {
+				panic(fmt.Sprintf("Missing dead letter source for route: %v", route.Statuses))
+			}
+		default:
+			panic(fmt.Sprintf("Unknown route action: %v", route.Action))
+		}
+		if source := routeConfig.GetString("source"); source != "" {
+			route.Source = getSource(sources, source)
+		}
+		opts = append(opts, pipe.WithRoute(route))
+	}
+	return
+}
+
 func createWorkers(v *viper.Viper, sources map[string]*v1.Source) []*pipe.Worker {
 	var wList []*pipe.Worker
 	pipesConfig := utils.ViperSubMap(v, "pipes")
@@ -110,7 +482,12 @@ func createWorkers(v *viper.Viper, sources map[string]*v1.Source) []*pipe.Worker
 		pipeConfig.SetDefault("rate.init", 10)
 		pipeConfig.SetDefault("rate.min", 1)
 		pipeConfig.SetDefault("rate.window", "30s")
+		pipeConfig.SetDefault("rate.limiter", "hillClimb")
+		pipeConfig.SetDefault("rate.backoffRatio", 0.9)
+		pipeConfig.SetDefault("rate.smoothing", 0.2)
+		pipeConfig.SetDefault("rate.tolerance", 1.5)
 		pipeConfig.SetDefault("source", "default")
+		pipeConfig.SetDefault("drainTimeout", v.GetDuration("drainTimeout"))
 		handler := createHandler(pipeConfig.Sub("handler"))
 
 		pipeSources := getPipeSources(sources, pipeConfig)
@@ -119,22 +496,118 @@ func createWorkers(v *viper.Viper, sources map[string]*v1.Source) []*pipe.Worker
 		writeToSource := pipeConfig.GetString("onError.writeTo.source")
 		if writeToSource != "" {
 			opts = append(opts, pipe.WithErrorSource(getSource(sources, writeToSource)))
+			if pipeConfig.GetBool("onError.writeTo.envelope") {
+				opts = append(opts, pipe.WithErrorEnvelope())
+			}
+		}
+
+		opts = append(opts, pipe.WithDrainTimeout(pipeConfig.GetDuration("drainTimeout")))
+
+		if pipeConfig.IsSet("coalesce") {
+			pipeConfig.SetDefault("coalesce.size", 10)
+			pipeConfig.SetDefault("coalesce.window", "100ms")
+			opts = append(opts, pipe.WithCoalescing(pipeConfig.GetInt("coalesce.size"), pipeConfig.GetDuration("coalesce.window")))
+		}
+
+		if pipeConfig.IsSet("heartbeat") {
+			opts = append(opts, pipe.WithHeartbeat(pipeConfig.GetDuration("heartbeat")))
+		}
+
+		if orderBy := pipeConfig.GetString("orderBy"); orderBy != "" {
+			key, err := utils.ParseKeyExpression(orderBy)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid orderBy of pipe %v: %v", name, err))
+			}
+			pipeConfig.SetDefault("orderBuffer", 1000)
+			buffer := pipeConfig.GetInt("orderBuffer")
+			if buffer <= 0 {
+				panic(fmt.Sprintf("Invalid orderBuffer of pipe %v, expected a positive number: %v", name, buffer))
+			}
+			opts = append(opts, pipe.WithOrdering(key, buffer))
+		}
+
+		if split := pipeConfig.GetString("split"); split != "" {
+			if split != "body" && !strings.HasPrefix(split, "body.") {
+				panic(fmt.Sprintf("Invalid split of pipe %v, expected body or body.<json path>: %v", name, split))
+			}
+			opts = append(opts, pipe.WithSplit(strings.TrimPrefix(strings.TrimPrefix(split, "body"), ".")))
 		}
 
-		if pipeConfig.IsSet("rate.fixed") {
-			opts = append(opts, pipe.WithFixedRate(pipeConfig.GetInt("rate.fixed")))
-		} else {
-			opts = append(opts, pipe.WithDynamicRate(pipeConfig.GetInt("rate.init"),
-				pipeConfig.GetInt("rate.min"),
-				pipeConfig.GetDuration("rate.window")))
+		if aggregateConfig := pipeConfig.Sub("aggregate"); aggregateConfig != nil {
+			aggregate := createAggregate(aggregateConfig)
+			if !pipeConfig.IsSet("heartbeat") {
+				sourcesConfig := utils.ViperSubMap(v, "sources")
+				for _, s := range pipeSources {
+					// Without a heartbeat the lease of waiting messages is extended once, the group must be written within it
+					if sourceConfig, ok := sourcesConfig[s.Name]; ok && sourceConfig.IsSet("visibilityTimeoutInSeconds") &&
+						aggregate.Window > time.Duration(sourceConfig.GetInt64("visibilityTimeoutInSeconds"))*time.Second/2 {
+						panic(fmt.Sprintf("Aggregate window of pipe %v must be below half of the %v visibility timeout, or set a heartbeat", name, s.Name))
+					}
+				}
+			}
+			opts = append(opts, pipe.WithAggregate(aggregate))
 		}
-		output := pipeConfig.GetString("output")
-		if output != "" {
+
+		if dedupConfig := pipeConfig.Sub("dedup"); dedupConfig != nil {
+			opts = append(opts, pipe.WithDeduplication(createDeduplication(dedupConfig, name)))
+		}
+
+		if pipeConfig.GetBool("unwrapEnvelope") {
+			opts = append(opts, pipe.WithEnvelopeUnwrap())
+		}
+
+		var retryPolicy *pipe.RetryPolicy
+		if retryConfig := pipeConfig.Sub("retry"); retryConfig != nil {
+			retryPolicy = createRetryPolicy(retryConfig)
+			opts = append(opts, pipe.WithRetryPolicy(retryPolicy))
+		}
+
+		if pipeConfig.IsSet("batch") {
+			pipeConfig.SetDefault("batch.size", 10)
+			pipeConfig.SetDefault("batch.window", "1s")
+			if _, ok := handler.(handlers.BatchHandler); !ok {
+				panic(fmt.Sprintf("Handler of pipe %v doesn't support batches", name))
+			}
+			if retryPolicy != nil && retryPolicy.Mode == pipe.RetryInProcess {
+				panic(fmt.Sprintf("In process retries are not supported with batches, pipe: %v", name))
+			}
+			opts = append(opts, pipe.WithBatch(pipeConfig.GetInt("batch.size"), pipeConfig.GetDuration("batch.window")))
+		}
+
+		opts = append(opts, createLimiter(pipeConfig))
+		if pipeConfig.IsSet("rate.perSecond") {
+			opts = append(opts, pipe.WithThroughputLimit(throughputLimit(pipeConfig.GetFloat64("rate.perSecond"), name), pipeConfig.GetInt("rate.burst")))
+		}
+		for sourceName, sourceRate := range utils.ViperSubMap(pipeConfig, "rate.sources") {
+			if !isPipeSource(pipeSources, sourceName) {
+				panic(fmt.Sprintf("Rate limited source %v isn't a source of pipe %v", sourceName, name))
+			}
+			opts = append(opts, pipe.WithSourceThroughputLimit(sourceName, throughputLimit(sourceRate.GetFloat64("perSecond"), name), sourceRate.GetInt("burst")))
+		}
+		if routerConfig := pipeConfig.Sub("output.router"); routerConfig != nil {
+			opts = append(opts, pipe.WithRouter(createRouter(routerConfig, sources)))
+		} else if output := pipeConfig.GetString("output"); output != "" {
 			opts = append(opts, pipe.WithOutput(getSource(sources, output)))
-		} else {
-			opts = append(opts, pipe.WithDynamicRate(pipeConfig.GetInt("rate.init"),
-				pipeConfig.GetInt("rate.min"),
-				pipeConfig.GetDuration("rate.window")))
+		}
+		opts = append(opts, createRoutes(pipeConfig, sources)...)
+		if filterConfig := pipeConfig.Sub("filter"); filterConfig != nil {
+			filter := createFilter(filterConfig, sources)
+			if filter.OnMismatch == pipe.FilterSkip {
+				sourcesConfig := utils.ViperSubMap(v, "sources")
+				for _, s := range pipeSources {
+					// Abandoning service bus messages counts as a delivery, skipped messages would be dead lettered
+					if sourceConfig, ok := sourcesConfig[s.Name]; ok && sourceConfig.GetString("type") == "service-bus" {
+						panic(fmt.Sprintf("Filter onMismatch skip is not supported by service bus source %v of pipe %v", s.Name, name))
+					}
+				}
+			}
+			opts = append(opts, pipe.WithFilter(filter))
+		}
+		if pipeConfig.IsSet("transform") {
+			opts = append(opts, pipe.WithTransforms(
+				createTransform(pipeConfig.Get("transform.request")),
+				createTransform(pipeConfig.Get("transform.response")),
+			))
 		}
 
 		wList = append(wList, pipe.NewWorker(
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func createTestApp(t *testing.T, yaml string) (*App, error) {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	return CreateApp(v)
+}
+
+func TestBatchRequiresBatchHandler(t *testing.T) {
+	_, err := createTestApp(t, `
+pipe:
+  source: stdout
+  batch:
+    size: 10
+  handler:
+    command:
+      path: cat
+`)
+	if err == nil || !strings.Contains(err.Error(), "doesn't support batches") {
+		t.Fatalf("expected a handler without batches to be rejected, got %v", err)
+	}
+
+	_, err = createTestApp(t, `
+pipe:
+  source: stdout
+  batch:
+    size: 10
+  handler:
+    http:
+      endpoint: http://localhost:8080/batch
+`)
+	if err != nil {
+		t.Fatalf("expected the http handler to support batches, got %v", err)
+	}
+}
+
+func TestRateValidation(t *testing.T) {
+	for _, c := range []struct {
+		rate     string
+		expected string
+	}{
+		{"perSecond: 0", "Invalid rate perSecond"},
+		{"perSecond: -1", "Invalid rate perSecond"},
+		{"sources: {stdout: {perSecond: 0}}", "Invalid rate perSecond"},
+		{"sources: {other: {perSecond: 5}}", "isn't a source of pipe"},
+		{"sources: {missing: {perSecond: 5}}", "isn't a source of pipe"},
+	} {
+		_, err := createTestApp(t, `
+sources:
+  other:
+    type: io
+pipe:
+  source: stdout
+  rate: {`+c.rate+`}
+  handler:
+    none: {}
+`)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("expected %v to be rejected with %v, got %v", c.rate, c.expected, err)
+		}
+	}
+
+	if _, err := createTestApp(t, `
+pipe:
+  source: stdout
+  rate: {perSecond: 10, sources: {stdout: {perSecond: 0.5}}}
+  handler:
+    none: {}
+`); err != nil {
+		t.Fatalf("expected valid rates to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package dedup
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltFile is a file shared by the stores of several pipes, it is closed with the last one.
+type boltFile struct {
+	db   *bolt.DB
+	refs int
+}
+
+var (
+	boltLock  sync.Mutex
+	boltFiles = map[string]*boltFile{}
+)
+
+// boltStore keeps the keys with their expiration time and whether they were processed in a bucket of a local file.
+type boltStore struct {
+	db        *bolt.DB
+	path      string
+	bucket    []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// openBolt opens every file once, bolt files are locked by the process that opened them.
+func openBolt(path string) (*bolt.DB, error) {
+	boltLock.Lock()
+	defer boltLock.Unlock()
+	if f, ok := boltFiles[path]; ok {
+		f.refs++
+		return f.db, nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	boltFiles[path] = &boltFile{db, 1}
+	return db, nil
+}
+
+// closeBolt closes the file once it isn't used by any store.
+func closeBolt(path string) error {
+	boltLock.Lock()
+	defer boltLock.Unlock()
+	f, ok := boltFiles[path]
+	if !ok {
+		return nil
+	}
+	if f.refs--; f.refs > 0 {
+		return nil
+	}
+	delete(boltFiles, path)
+	return f.db.Close()
+}
+
+// NewBoltStore stores the keys in a bucket of the file, expired keys are removed every cleanup interval.
+func NewBoltStore(path string, bucket string, cleanupInterval time.Duration) (Store, error) {
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStore{db: db, path: path, bucket: []byte(bucket), done: make(chan struct{})}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	}); err != nil {
+		closeBolt(path)
+		return nil, err
+	}
+	if cleanupInterval > 0 {
+		go s.cleanup(cleanupInterval)
+	}
+	return s, nil
+}
+
+func entry(ttl time.Duration, processed bool) []byte {
+	value := make([]byte, 9)
+	binary.BigEndian.PutUint64(value, uint64(time.Now().Add(ttl).UnixNano()))
+	if processed {
+		value[8] = 1
+	}
+	return value
+}
+
+func expired(value []byte, now int64) bool {
+	return len(value) != 9 || now >= int64(binary.BigEndian.Uint64(value))
+}
+
+func (s *boltStore) Reserve(ctx context.Context, key string, ttl time.Duration) (reservation Reservation, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if value := bucket.Get([]byte(key)); value != nil && !expired(value, time.Now().UnixNano()) {
+			reservation = InFlight
+			if value[8] == 1 {
+				reservation = Processed
+			}
+			return nil
+		}
+		return bucket.Put([]byte(key), entry(ttl, false))
+	})
+	return
+}
+
+func (s *boltStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(key), entry(ttl, true))
+	})
+}
+
+func (s *boltStore) Release(ctx context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(key))
+	})
+}
+
+// Close stops the cleanup and closes the file once no other store uses it.
+func (s *boltStore) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = closeBolt(s.path)
+	})
+	return
+}
+
+func (s *boltStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.removeExpired()
+	}
+}
+
+// removeExpired deletes expired keys, they are collected first since deleting moves the cursor.
+func (s *boltStore) removeExpired() error {
+	now := time.Now().UnixNano()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		var keys [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if expired(v, now) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
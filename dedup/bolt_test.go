@@ -0,0 +1,85 @@
+package dedup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func tempBoltPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dqd-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "dedup.db")
+}
+
+func TestBoltStore(t *testing.T) {
+	s, err := NewBoltStore(tempBoltPath(t), "pipe", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestBoltStoreRemovesAllExpiredKeys(t *testing.T) {
+	s, err := NewBoltStore(tempBoltPath(t), "pipe", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	store := s.(*boltStore)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		expectReservation(t, s, key, time.Millisecond, Reserved)
+	}
+	expectReservation(t, s, "e", time.Minute, Reserved)
+	time.Sleep(10 * time.Millisecond)
+
+	if err := store.removeExpired(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(store.bucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if len(keys) != 1 || keys[0] != "e" {
+		t.Fatalf("expected only the unexpired key to be kept, got %v", keys)
+	}
+}
+
+func TestBoltStoreClosesFileWithLastStore(t *testing.T) {
+	path := tempBoltPath(t)
+	first, err := NewBoltStore(path, "first", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewBoltStore(path, "second", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectReservation(t, second, "a", time.Minute, Reserved)
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := boltFiles[path]; ok {
+		t.Fatal("expected the file to be closed")
+	}
+
+	reopened, err := NewBoltStore(path, "second", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	expectReservation(t, reopened, "a", time.Minute, InFlight)
+}
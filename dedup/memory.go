@@ -0,0 +1,81 @@
+package dedup
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	key       string
+	expires   time.Time
+	processed bool
+}
+
+// memoryStore keeps up to size keys, the least recently used keys are evicted first.
+type memoryStore struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func NewMemoryStore(size int) Store {
+	return &memoryStore{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (s *memoryStore) Reserve(ctx context.Context, key string, ttl time.Duration) (Reservation, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.entries[key]; ok && time.Now().Before(e.Value.(*memoryEntry).expires) {
+		s.order.MoveToFront(e)
+		if e.Value.(*memoryEntry).processed {
+			return Processed, nil
+		}
+		return InFlight, nil
+	}
+	s.set(key, ttl, false)
+	return Reserved, nil
+}
+
+func (s *memoryStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.set(key, ttl, true)
+	return nil
+}
+
+func (s *memoryStore) Release(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.order.Remove(e)
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) set(key string, ttl time.Duration, processed bool) {
+	expires := time.Now().Add(ttl)
+	if e, ok := s.entries[key]; ok {
+		e.Value.(*memoryEntry).expires = expires
+		e.Value.(*memoryEntry).processed = processed
+		s.order.MoveToFront(e)
+		return
+	}
+	s.entries[key] = s.order.PushFront(&memoryEntry{key, expires, processed})
+	for s.size > 0 && s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
@@ -0,0 +1,22 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(10))
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := NewMemoryStore(2)
+	expectReservation(t, s, "a", time.Minute, Reserved)
+	expectReservation(t, s, "b", time.Minute, Reserved)
+	// Checking a refreshes it, b is evicted instead
+	expectReservation(t, s, "a", time.Minute, InFlight)
+	expectReservation(t, s, "c", time.Minute, Reserved)
+
+	expectReservation(t, s, "a", time.Minute, InFlight)
+	expectReservation(t, s, "b", time.Minute, Reserved)
+}
@@ -0,0 +1,193 @@
+package dedup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RedisOptions struct {
+	Address  string
+	Password string
+	DB       int
+	Prefix   string
+	Timeout  time.Duration
+	// PoolSize is the number of idle connections kept open.
+	PoolSize int
+}
+
+// redisStore keeps the keys in redis with their ttl, it talks the redis protocol over a pool of connections.
+type redisStore struct {
+	*RedisOptions
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisStore(options *RedisOptions) Store {
+	return &redisStore{
+		RedisOptions: options,
+		idle:         make(chan *redisConn, options.PoolSize),
+	}
+}
+
+// Values of reserved and processed keys.
+const (
+	valueInFlight  = "in-flight"
+	valueProcessed = "processed"
+)
+
+func (s *redisStore) Reserve(ctx context.Context, key string, ttl time.Duration) (Reservation, error) {
+	reply, err := s.do(ctx, "SET", s.Prefix+key, valueInFlight, "NX", "PX", milliseconds(ttl))
+	if err != nil || reply == "OK" {
+		return Reserved, err
+	}
+	reply, err = s.do(ctx, "GET", s.Prefix+key)
+	if err != nil {
+		return Reserved, err
+	}
+	if reply == valueProcessed {
+		return Processed, nil
+	}
+	return InFlight, nil
+}
+
+func (s *redisStore) Mark(ctx context.Context, key string, ttl time.Duration) error {
+	_, err := s.do(ctx, "SET", s.Prefix+key, valueProcessed, "PX", milliseconds(ttl))
+	return err
+}
+
+func (s *redisStore) Release(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DEL", s.Prefix+key)
+	return err
+}
+
+func (s *redisStore) Close() error {
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+// do sends the command over an idle connection, or a new one when none is idle. Connections that failed are closed.
+func (s *redisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-s.idle:
+	default:
+		var err error
+		if conn, err = s.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(ctx, conn, args...)
+	if err != nil {
+		if _, isReplyErr := err.(redisError); !isReplyErr {
+			conn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (s *redisStore) connect(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	c, err := dialer.DialContext(ctx, "tcp", s.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{c, bufio.NewReader(c)}
+	if s.Password != "" {
+		if _, err = s.roundTrip(ctx, conn, "AUTH", s.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.DB != 0 {
+		if _, err = s.roundTrip(ctx, conn, "SELECT", strconv.Itoa(s.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *redisStore) roundTrip(ctx context.Context, conn *redisConn, args ...string) (interface{}, error) {
+	var deadline time.Time
+	if s.Timeout > 0 {
+		deadline = time.Now().Add(s.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(command.String())); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+// redisError is an error reply, the connection can still be used.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply reads simple strings, errors, integers and bulk strings, a nil bulk string is returned as nil.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	}
+	return nil, fmt.Errorf("unsupported redis reply: %v", line)
+}
@@ -0,0 +1,223 @@
+package dedup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the commands used by the store, values are kept with their expiration time.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	lock     sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: listener, password: password, values: map[string]string{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if args[0] == "AUTH" {
+			authenticated = len(args) == 2 && args[1] == r.password
+		}
+		var reply string
+		if !authenticated {
+			reply = "-NOAUTH Authentication required.\r\n"
+		} else {
+			reply = r.execute(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) execute(args []string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.commands = append(r.commands, strings.Join(args, " "))
+	switch args[0] {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		r.expire(args[1])
+		value, ok := r.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "DEL":
+		delete(r.values, args[1])
+		return ":1\r\n"
+	case "SET":
+		r.expire(args[1])
+		key, value := args[1], args[2]
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch args[i] {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, exists := r.values[key]; nx && exists {
+			return "$-1\r\n"
+		}
+		r.values[key] = value
+		r.expires[key] = time.Now().Add(ttl)
+		return "+OK\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (r *fakeRedis) expire(key string) {
+	if expires, ok := r.expires[key]; ok && time.Now().After(expires) {
+		delete(r.values, key)
+		delete(r.expires, key)
+	}
+}
+
+func (r *fakeRedis) executed() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	s := NewRedisStore(&RedisOptions{
+		Address:  server.listener.Addr().String(),
+		Password: "secret",
+		DB:       2,
+		Prefix:   "dqd:test:",
+		Timeout:  time.Second,
+		PoolSize: 2,
+	})
+	testStore(t, s)
+
+	commands := server.executed()
+	if commands[0] != "AUTH secret" || commands[1] != "SELECT 2" {
+		t.Fatalf("expected the connection to authenticate and select the db, got %v", commands[:2])
+	}
+	if commands[2] != "SET dqd:test:a in-flight NX PX 60000" {
+		t.Fatalf("expected an atomic reservation, got %v", commands[2])
+	}
+	connects := 0
+	for _, c := range commands {
+		if strings.HasPrefix(c, "AUTH") {
+			connects++
+		}
+	}
+	if connects != 1 {
+		t.Fatalf("expected connections to be reused, connected %v times", connects)
+	}
+}
+
+func TestRedisStoreConcurrentReservations(t *testing.T) {
+	server := newFakeRedis(t, "")
+	s := NewRedisStore(&RedisOptions{Address: server.listener.Addr().String(), Timeout: time.Second, PoolSize: 4})
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reservation, err := s.Reserve(context.Background(), "key", time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if reservation == Reserved {
+				lock.Lock()
+				reserved++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 1 {
+		t.Fatalf("expected a single reservation, got %v", reserved)
+	}
+}
+
+func TestRedisStoreUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	s := NewRedisStore(&RedisOptions{Address: address, Timeout: 100 * time.Millisecond, PoolSize: 1})
+	if _, err := s.Reserve(context.Background(), "key", time.Minute); err == nil {
+		t.Fatal("expected an error when redis is unavailable")
+	}
+}
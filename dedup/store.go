@@ -0,0 +1,29 @@
+package dedup
+
+import (
+	"context"
+	"time"
+)
+
+// Reservation is the state of a key when it was reserved.
+type Reservation int
+
+const (
+	// Reserved keys were not recorded, the message should be handled.
+	Reserved Reservation = iota
+	// InFlight keys are reserved by a message that is being handled.
+	InFlight
+	// Processed keys belong to messages that were processed.
+	Processed
+)
+
+// Store records the keys of messages that are handled or were processed.
+type Store interface {
+	// Reserve records the key for the ttl unless it is already recorded, it returns the state of recorded keys.
+	Reserve(ctx context.Context, key string, ttl time.Duration) (Reservation, error)
+	// Mark records the key as processed for the ttl.
+	Mark(ctx context.Context, key string, ttl time.Duration) error
+	// Release removes the key so the message can be handled again.
+	Release(ctx context.Context, key string) error
+	Close() error
+}
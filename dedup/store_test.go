@@ -0,0 +1,43 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func expectReservation(t *testing.T, s Store, key string, ttl time.Duration, expected Reservation) {
+	t.Helper()
+	reservation, err := s.Reserve(context.Background(), key, ttl)
+	if err != nil {
+		t.Fatalf("Reserve(%q) failed: %v", key, err)
+	}
+	if reservation != expected {
+		t.Fatalf("Reserve(%q) = %v, expected %v", key, reservation, expected)
+	}
+}
+
+// testStore checks the reservation lifecycle every store implements.
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	expectReservation(t, s, "a", time.Minute, Reserved)
+	expectReservation(t, s, "a", time.Minute, InFlight)
+
+	if err := s.Release(ctx, "a"); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	expectReservation(t, s, "a", time.Minute, Reserved)
+
+	if err := s.Mark(ctx, "a", time.Minute); err != nil {
+		t.Fatalf("Mark failed: %v", err)
+	}
+	expectReservation(t, s, "a", time.Minute, Processed)
+
+	expectReservation(t, s, "b", 50*time.Millisecond, Reserved)
+	time.Sleep(100 * time.Millisecond)
+	expectReservation(t, s, "b", time.Minute, Reserved)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
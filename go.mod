@@ -24,8 +24,11 @@ require (
 	github.com/spf13/viper v1.6.2
 	github.com/tsenart/go-tsz v0.0.0-20180814235614-0bd30b3df1c3 // indirect
 	github.com/tsenart/vegeta v12.7.0+incompatible // indirect
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e // indirect
 	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
+	google.golang.org/grpc v1.29.1
 	gopkg.in/eapache/go-resiliency.v1 v1.2.0
 	gopkg.in/h2non/gentleman.v2 v2.0.4
 )
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"context"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type BatchResult struct {
+	Message *v1.RawMessage
+	Error   HandlerError
+}
+
+// BatchHandler handles several messages of a source in a single call.
+// Results are returned in the order of the messages, an error fails the whole batch.
+type BatchHandler interface {
+	Handler
+	HandleBatch(ctx context.Context, source string, messages []v1.Message) ([]*BatchResult, HandlerError)
+}
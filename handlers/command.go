@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/backoff"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// exitDataErr is the sysexits EX_DATAERR code, commands exit with it to reject a message as a bad request.
+const exitDataErr = 65
+
+// maxLineSize bounds a single reply line of a persistent command.
+const maxLineSize = 64 * 1024 * 1024
+
+type CommandHandlerOptions struct {
+	Path       string
+	Args       []string
+	Env        map[string]string
+	Persistent bool
+	Timeout    time.Duration
+}
+
+type commandHandler struct {
+	options *CommandHandlerOptions
+	lock    sync.Mutex
+	process *commandProcess
+	// restarts delays starting the command again after it exited, it's reset once the command replies
+	restarts  *backoff.Backoff
+	nextStart time.Time
+	closed    bool
+}
+
+// commandProcess is a long lived command exchanging newline delimited json messages over stdin and stdout.
+type commandProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writes  chan *wireMessage
+	lock    sync.Mutex
+	pending map[string]chan *wireMessage
+	seq     uint64
+	done    chan struct{}
+}
+
+func metadataEnv(metadata v1.Metadata) []string {
+	var env []string
+	for k, v := range metadata {
+		name := strings.Map(func(r rune) rune {
+			if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, strings.ToUpper(k))
+		env = append(env, fmt.Sprintf("DQD_META_%v=%v", name, v))
+	}
+	return env
+}
+
+func (h *commandHandler) env() []string {
+	env := os.Environ()
+	for k, v := range h.options.Env {
+		env = append(env, fmt.Sprintf("%v=%v", k, v))
+	}
+	return env
+}
+
+func (h *commandHandler) HealthStatus() v1.HealthStatus {
+	status := v1.Healthy
+	if _, err := exec.LookPath(h.options.Path); err != nil {
+		status = v1.Error(err)
+	}
+	return v1.NewHealthStatus(status)
+}
+
+func (h *commandHandler) Handle(ctx *v1.RequestContext, message v1.Message) (*v1.RawMessage, HandlerError) {
+	callCtx, cancel := context.WithTimeout(ctx, h.options.Timeout)
+	defer cancel()
+	if h.options.Persistent {
+		return h.call(callCtx, message)
+	}
+	return h.run(callCtx, ctx.Source(), message)
+}
+
+// run starts the command for a single message, passing the payload on stdin and metadata as env vars.
+func (h *commandHandler) run(ctx context.Context, source string, message v1.Message) (*v1.RawMessage, HandlerError) {
+	cmd := exec.CommandContext(ctx, h.options.Path, h.options.Args...)
+	cmd.Env = append(h.env(), metadataEnv(message.Metadata())...)
+	cmd.Env = append(cmd.Env, "DQD_SOURCE="+source, "DQD_MESSAGE_ID="+message.Id())
+	cmd.Stdin = bytes.NewReader(message.Data())
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		logger.Debug().Str("command", h.options.Path).Str("stderr", stderr.String()).Msg("Command output")
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == exitDataErr {
+			return nil, BadRequestError(fmt.Errorf("command rejected message: %w", err))
+		}
+		return nil, ServerError(fmt.Errorf("command failed: %w", err))
+	}
+	return &v1.RawMessage{
+		Data: stdout.Bytes(),
+	}, nil
+}
+
+func (h *commandHandler) call(ctx context.Context, message v1.Message) (*v1.RawMessage, HandlerError) {
+	p, err := h.ensureProcess()
+	if err != nil {
+		return nil, ServerError(err)
+	}
+	reply, err := p.call(ctx, newWireMessage("", message.Data(), message.Metadata()))
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Warn().Str("command", h.options.Path).Msg("Command timed out, killing it")
+			p.kill()
+		}
+		return nil, ServerError(err)
+	}
+	h.lock.Lock()
+	h.restarts.Reset()
+	h.lock.Unlock()
+	return reply.result()
+}
+
+// Close kills the persistent command, it isn't started again.
+func (h *commandHandler) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	if h.process != nil {
+		h.process.kill()
+	}
+	return nil
+}
+
+// ensureProcess returns the running command, starting it again if it exited and the restart backoff elapsed.
+func (h *commandHandler) ensureProcess() (*commandProcess, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil, fmt.Errorf("command handler closed")
+	}
+	if h.process != nil {
+		select {
+		case <-h.process.done:
+		default:
+			return h.process, nil
+		}
+		if wait := time.Until(h.nextStart); wait > 0 {
+			return nil, fmt.Errorf("command exited, restarting in %v", wait.Round(time.Millisecond))
+		}
+	}
+	h.nextStart = time.Now().Add(h.restarts.Duration())
+
+	cmd := exec.Command(h.options.Path, h.options.Args...)
+	cmd.Env = h.env()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &commandProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		writes:  make(chan *wireMessage),
+		pending: map[string]chan *wireMessage{},
+		done:    make(chan struct{}),
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logger.Debug().Str("command", h.options.Path).Str("stderr", scanner.Text()).Msg("Command output")
+		}
+	}()
+	go p.readReplies(stdout)
+	go p.writeRequests()
+	h.process = p
+	logger.Info().Str("command", h.options.Path).Int("pid", cmd.Process.Pid).Msg("Started command")
+	return p, nil
+}
+
+func (p *commandProcess) readReplies(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		var reply wireMessage
+		if err := json.Unmarshal(scanner.Bytes(), &reply); err != nil {
+			logger.Warn().Err(err).Msg("Invalid command reply")
+			continue
+		}
+		p.lock.Lock()
+		ch, ok := p.pending[reply.Id]
+		delete(p.pending, reply.Id)
+		p.lock.Unlock()
+		if ok {
+			ch <- &reply
+		}
+	}
+	err := p.cmd.Wait()
+	logger.Warn().Err(err).Msg("Command exited")
+	close(p.done)
+}
+
+// writeRequests writes the requests to stdin, so a command that stops reading only blocks the callers until their timeout.
+func (p *commandProcess) writeRequests() {
+	encoder := json.NewEncoder(p.stdin)
+	for {
+		select {
+		case request := <-p.writes:
+			if err := encoder.Encode(request); err != nil {
+				logger.Warn().Err(err).Msg("Failed writing to command, killing it")
+				p.kill()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *commandProcess) kill() {
+	select {
+	case <-p.done:
+	default:
+		p.cmd.Process.Kill()
+	}
+}
+
+func (p *commandProcess) call(ctx context.Context, request *wireMessage) (*wireMessage, error) {
+	request.Id = strconv.FormatUint(atomic.AddUint64(&p.seq, 1), 10)
+	reply := make(chan *wireMessage, 1)
+
+	p.lock.Lock()
+	p.pending[request.Id] = reply
+	p.lock.Unlock()
+
+	var err error
+	select {
+	case p.writes <- request:
+		select {
+		case r := <-reply:
+			return r, nil
+		case <-p.done:
+			err = fmt.Errorf("command exited")
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	case <-p.done:
+		err = fmt.Errorf("command exited")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.lock.Lock()
+	delete(p.pending, request.Id)
+	p.lock.Unlock()
+	return nil, err
+}
+
+func NewCommandHandler(options *CommandHandlerOptions) Handler {
+	return &commandHandler{
+		options:  options,
+		restarts: &backoff.Backoff{Min: time.Second, Max: time.Minute},
+	}
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func newShellHandler(script string, persistent bool, timeout time.Duration) *commandHandler {
+	return NewCommandHandler(&CommandHandlerOptions{
+		Path:       "/bin/sh",
+		Args:       []string{"-c", script},
+		Persistent: persistent,
+		Timeout:    timeout,
+	}).(*commandHandler)
+}
+
+func TestCommandPerMessage(t *testing.T) {
+	h := newShellHandler(`printf '%s-%s-%s' "$(cat)" "$DQD_META_USER_ID" "$DQD_MESSAGE_ID"`, false, 5*time.Second)
+	m := &testMessage{id: "1", data: []byte("hello"), metadata: v1.Metadata{"user-id": "42"}}
+	res, err := handleMessage(h, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Data) != "hello-42-1" {
+		t.Fatalf("expected the payload, metadata and id to be passed, got %q", res.Data)
+	}
+}
+
+func TestCommandPerMessageErrors(t *testing.T) {
+	m := &testMessage{id: "1", data: []byte("hello")}
+	if _, err := handleMessage(newShellHandler("exit 65", false, 5*time.Second), m); err == nil || err.Code() != 4 {
+		t.Fatalf("expected EX_DATAERR to reject the message, got %v", err)
+	}
+	if _, err := handleMessage(newShellHandler("exit 1", false, 5*time.Second), m); err == nil || err.Code() != 5 {
+		t.Fatalf("expected a failure to be a server error, got %v", err)
+	}
+	start := time.Now()
+	if _, err := handleMessage(newShellHandler("exec sleep 10", false, 100*time.Millisecond), m); err == nil {
+		t.Fatal("expected the timeout to fail the message")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected the command to be killed on timeout")
+	}
+}
+
+// echoScript replies to every request with its id and a constant body.
+const echoScript = `while read -r line; do
+  id=$(printf '%s' "$line" | sed 's/.*"id":"\([^"]*\)".*/\1/')
+  printf '{"id":"%s","body":{"pid":%s}}\n' "$id" "$$"
+done`
+
+func TestCommandPersistent(t *testing.T) {
+	h := newShellHandler(echoScript, true, 5*time.Second)
+	defer h.Close()
+	m := &testMessage{id: "1", data: []byte(`{"a":1}`)}
+	first, err := handleMessage(h, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := handleMessage(h, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(first.Data), `{"pid":`) {
+		t.Fatalf("unexpected reply %q", first.Data)
+	}
+	if string(first.Data) != string(second.Data) {
+		t.Fatalf("expected the same process to handle both messages, got %q and %q", first.Data, second.Data)
+	}
+}
+
+func TestCommandPersistentConcurrentCalls(t *testing.T) {
+	h := newShellHandler(echoScript, true, 5*time.Second)
+	defer h.Close()
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			if _, err := handleMessage(h, &testMessage{id: "1", data: []byte("x")}); err != nil {
+				errs <- err
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCommandPersistentTimeoutKillsAndBacksOff(t *testing.T) {
+	h := newShellHandler("exec cat > /dev/null", true, 100*time.Millisecond)
+	defer h.Close()
+	m := &testMessage{id: "1", data: []byte("x")}
+	if _, err := handleMessage(h, m); err == nil {
+		t.Fatal("expected the call to time out")
+	}
+	h.lock.Lock()
+	p := h.process
+	h.lock.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the command to be killed on timeout")
+	}
+	_, err := handleMessage(h, m)
+	if err == nil || !strings.Contains(err.Error(), "restarting") {
+		t.Fatalf("expected the restart to be delayed, got %v", err)
+	}
+}
+
+func TestCommandClose(t *testing.T) {
+	h := newShellHandler(echoScript, true, 5*time.Second)
+	m := &testMessage{id: "1", data: []byte("x")}
+	if _, err := handleMessage(h, m); err != nil {
+		t.Fatal(err)
+	}
+	p := h.process
+	h.Close()
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the command to be killed on close")
+	}
+	if _, err := handleMessage(h, m); err == nil {
+		t.Fatal("expected a closed handler not to start the command again")
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/soluto/dqd/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type grpcHandler struct {
+	conn          *grpc.ClientConn
+	method        string
+	healthService string
+	timeout       time.Duration
+	metadata      map[string]string
+}
+
+type GrpcHandlerOptions struct {
+	Address       string
+	Method        string
+	HealthService string
+	Timeout       time.Duration
+	TLS           bool
+	Metadata      map[string]string
+}
+
+// rawCodec passes the message payload as is, it should already be a serialized request.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type: %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type: %T", v)
+	}
+	*b = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// grpcStatuses maps grpc codes to the matching http status codes.
+var grpcStatuses = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+func grpcError(err error, trailer metadata.MD) HandlerError {
+	s, ok := status.FromError(err)
+	if !ok {
+		return ServerError(err)
+	}
+	httpStatus, ok := grpcStatuses[s.Code()]
+	if !ok {
+		httpStatus = http.StatusInternalServerError
+	}
+	if pushback := trailer.Get("grpc-retry-pushback-ms"); len(pushback) > 0 {
+		if ms, convErr := strconv.Atoi(pushback[0]); convErr == nil && ms > 0 {
+			return ThrottledError(httpStatus, time.Duration(ms)*time.Millisecond, err)
+		}
+	}
+	return StatusError(httpStatus, err)
+}
+
+func (h *grpcHandler) HealthStatus() v1.HealthStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := healthpb.NewHealthClient(h.conn).Check(ctx, &healthpb.HealthCheckRequest{Service: h.healthService})
+	status := v1.Healthy
+	if err != nil {
+		status = v1.Error(err)
+	} else if res.Status != healthpb.HealthCheckResponse_SERVING {
+		status = v1.Error(fmt.Errorf("grpc health status: %v", res.Status))
+	}
+	return v1.NewHealthStatus(status)
+}
+
+func (h *grpcHandler) Handle(ctx *v1.RequestContext, message v1.Message) (*v1.RawMessage, HandlerError) {
+	md := metadata.New(h.metadata)
+	md.Set("x-dqd-source", ctx.Source())
+	prefix := strings.ToLower(v1.MetadataHeaderPrefix)
+	for k, v := range message.Metadata() {
+		md.Set(prefix+k, v)
+	}
+	callCtx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, md), h.timeout)
+	defer cancel()
+
+	req := message.Data()
+	var res []byte
+	var header, trailer metadata.MD
+	err := h.conn.Invoke(callCtx, h.method, &req, &res, grpc.ForceCodec(rawCodec{}), grpc.Header(&header), grpc.Trailer(&trailer))
+	if err != nil {
+		return nil, grpcError(err, trailer)
+	}
+	return &v1.RawMessage{
+		Data:     res,
+		Metadata: responseMetadata(header),
+	}, nil
+}
+
+// responseMetadata reads the response metadata from the grpc headers, grpc keys are lower case so they are
+// canonicalized first. The content type is dropped since it's the grpc content type and not the payload's.
+func responseMetadata(header metadata.MD) v1.Metadata {
+	h := http.Header{}
+	for k, v := range header {
+		if k == "content-type" {
+			continue
+		}
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	return v1.MetadataFromHeaders(h)
+}
+
+func NewGrpcHandler(options *GrpcHandlerOptions) Handler {
+	creds := grpc.WithInsecure()
+	if options.TLS {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	conn, err := grpc.Dial(options.Address, creds)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create grpc handler: %v", err))
+	}
+	return &grpcHandler{
+		conn:          conn,
+		method:        options.Method,
+		healthService: options.HealthService,
+		timeout:       options.Timeout,
+		metadata:      options.Metadata,
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	v1 "github.com/soluto/dqd/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// serverCodec lets the test server receive the raw payloads.
+type serverCodec struct {
+	rawCodec
+}
+
+func (serverCodec) String() string {
+	return "raw"
+}
+
+func newBufconnHandler(t *testing.T, opts ...grpc.ServerOption) (*grpcHandler, *grpc.Server) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(opts...)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go server.Serve(listener)
+	return &grpcHandler{
+		conn:     conn,
+		method:   "/test.Echo/Echo",
+		timeout:  5 * time.Second,
+		metadata: map[string]string{"authorization": "token"},
+	}, server
+}
+
+// echo replies with the request payload, and passes back the request metadata as response headers.
+func echo(_ interface{}, stream grpc.ServerStream) error {
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if md.Get("x-dqd-meta-fail") != nil {
+		stream.SetTrailer(metadata.Pairs("grpc-retry-pushback-ms", "1500"))
+		return status.Error(codes.ResourceExhausted, "slow down")
+	}
+	header := metadata.Pairs(
+		"x-dqd-meta-source", md.Get("x-dqd-source")[0],
+		"x-dqd-meta-authorization", md.Get("authorization")[0],
+		"x-dqd-meta-user-id", md.Get("x-dqd-meta-user-id")[0],
+	)
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
+	return stream.SendMsg(&req)
+}
+
+func TestGrpcHandle(t *testing.T) {
+	h, _ := newBufconnHandler(t, grpc.CustomCodec(serverCodec{}), grpc.UnknownServiceHandler(echo))
+	m := &testMessage{id: "1", data: []byte{0x0a, 0x03, 'a', 'b', 'c'}, metadata: v1.Metadata{"user-id": "42"}}
+	res, err := handleMessage(h, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Data) != string(m.data) {
+		t.Fatalf("expected the payload to be passed as is, got %v", res.Data)
+	}
+	expected := v1.Metadata{"source": "test", "authorization": "token", "user-id": "42"}
+	if len(res.Metadata) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, res.Metadata)
+	}
+	for k, v := range expected {
+		if res.Metadata[k] != v {
+			t.Fatalf("expected %v to be %v, got %v", k, v, res.Metadata)
+		}
+	}
+}
+
+func TestGrpcHandleError(t *testing.T) {
+	h, _ := newBufconnHandler(t, grpc.CustomCodec(serverCodec{}), grpc.UnknownServiceHandler(echo))
+	_, err := handleMessage(h, &testMessage{id: "1", metadata: v1.Metadata{"fail": "true"}})
+	if err == nil || err.Status() != 429 {
+		t.Fatalf("expected resource exhausted to be a 429, got %v", err)
+	}
+	if retryAfter, throttled := IsThrottled(err); !throttled || retryAfter != 1500*time.Millisecond {
+		t.Fatalf("expected the pushback to be the retry delay, got %v", retryAfter)
+	}
+}
+
+func TestGrpcHealthStatus(t *testing.T) {
+	h, server := newBufconnHandler(t)
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	h.healthService = "test.Echo"
+
+	healthServer.SetServingStatus("test.Echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	if h.HealthStatus().IsHealthy() {
+		t.Fatal("expected a not serving service to be unhealthy")
+	}
+	healthServer.SetServingStatus("test.Echo", healthpb.HealthCheckResponse_SERVING)
+	if !h.HealthStatus().IsHealthy() {
+		t.Fatalf("expected a serving service to be healthy, got %v", h.HealthStatus())
+	}
+	h.healthService = "unknown"
+	if h.HealthStatus().IsHealthy() {
+		t.Fatal("expected an unknown service to be unhealthy")
+	}
+}
+
+func TestGrpcResponseMetadata(t *testing.T) {
+	m := responseMetadata(metadata.Pairs("content-type", "application/grpc", "x-dqd-meta-user-id", "42", "other", "value"))
+	if len(m) != 1 || m["user-id"] != "42" {
+		t.Fatalf("expected only the prefixed keys, got %v", m)
+	}
+}
@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/rs/zerolog/log"
 	v1 "github.com/soluto/dqd/v1"
 )
@@ -12,33 +15,93 @@ type HandlerErrorCode int
 type HandlerError interface {
 	error
 	Code() HandlerErrorCode
+	// Status returns the http status code of the handler response, 0 when unknown.
+	Status() int
+	// RetryAfter returns the delay requested by the handler, 0 when not requested.
+	RetryAfter() time.Duration
 }
 
 type handlerError struct {
-	code  int
-	error error
+	code       int
+	status     int
+	retryAfter time.Duration
+	error      error
 }
 
 func (e *handlerError) Code() HandlerErrorCode {
 	return HandlerErrorCode(e.code)
 }
 
+func (e *handlerError) Status() int {
+	return e.status
+}
+
+func (e *handlerError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
 func (e *handlerError) Error() string {
 	return e.error.Error()
 }
 
 func ServerError(err error) HandlerError {
 	return &handlerError{
-		5,
-		err,
+		code:  5,
+		error: err,
 	}
 }
 
 func BadRequestError(err error) HandlerError {
 	return &handlerError{
-		4,
-		err,
+		code:  4,
+		error: err,
+	}
+}
+
+// StatusError classifies the error by its http status code.
+func StatusError(status int, err error) HandlerError {
+	return &handlerError{
+		code:   status / 100,
+		status: status,
+		error:  err,
+	}
+}
+
+// ThrottledError is returned when the handler asks to be called again after a delay.
+func ThrottledError(status int, retryAfter time.Duration, err error) HandlerError {
+	return &handlerError{
+		code:       status / 100,
+		status:     status,
+		retryAfter: retryAfter,
+		error:      err,
+	}
+}
+
+// defaultRetryAfter is used for 429 responses that don't specify a delay.
+const defaultRetryAfter = time.Second
+
+// IsThrottled reports whether the handler asked to slow down, and for how long.
+func IsThrottled(err error) (time.Duration, bool) {
+	handlerErr, ok := err.(HandlerError)
+	if !ok {
+		return 0, false
+	}
+	if handlerErr.RetryAfter() > 0 {
+		return handlerErr.RetryAfter(), true
 	}
+	if handlerErr.Status() == http.StatusTooManyRequests {
+		return defaultRetryAfter, true
+	}
+	return 0, false
+}
+
+// IsBackpressure reports whether the error signals an overloaded handler.
+func IsBackpressure(err error) bool {
+	handlerErr, ok := err.(HandlerError)
+	if !ok {
+		return false
+	}
+	return handlerErr.Code() == 5 || handlerErr.Status() == http.StatusTooManyRequests
 }
 
 // Handler handles queue messages.
@@ -46,3 +109,8 @@ type Handler interface {
 	v1.HealthChecker
 	Handle(*v1.RequestContext, v1.Message) (*v1.RawMessage, HandlerError)
 }
+
+// HandlerCloser is implemented by handlers that keep processes or connections, it is called once the pipe stopped.
+type HandlerCloser interface {
+	Close() error
+}
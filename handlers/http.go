@@ -1,9 +1,14 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -24,6 +29,8 @@ type HttpHandlerOptions struct {
 	Headers  map[string]string
 }
 
+const defaultContentType = "application/json"
+
 var handlerLogger = log.With().Str("scope", "Handler")
 
 func (h *httpHandler) HealthStatus() v1.HealthStatus {
@@ -41,23 +48,105 @@ func (h *httpHandler) HealthStatus() v1.HealthStatus {
 }
 
 func (h *httpHandler) Handle(ctx *v1.RequestContext, message v1.Message) (*v1.RawMessage, HandlerError) {
-	res, err := h.client.Post().AddHeader("x-dqd-source", ctx.Source()).JSON(message.Data()).Send()
+	metadata := message.Metadata()
+	req := h.client.Post().
+		AddHeader("x-dqd-source", ctx.Source()).
+		SetHeader("Content-Type", defaultContentType).
+		SetHeaders(metadata.Headers()).
+		Body(bytes.NewReader(message.Data()))
+	res, err := req.Send()
 	if err != nil {
 		return nil, ServerError(err)
 	}
-	if err == nil {
-		if res.ServerError {
-			return nil, ServerError(fmt.Errorf("invalid server response: %d", res.StatusCode))
-		}
-		if res.ClientError {
-			return nil, BadRequestError(fmt.Errorf("invalid client response: %d", res.StatusCode))
-		}
+	if handlerErr := responseError(res); handlerErr != nil {
+		return nil, handlerErr
 	}
+	resMetadata := v1.MetadataFromHeaders(res.Header)
+	resMetadata[v1.MetadataStatusCode] = strconv.Itoa(res.StatusCode)
 	return &v1.RawMessage{
-		Data: res.String(),
+		Data:     res.Bytes(),
+		Metadata: resMetadata,
 	}, nil
 }
 
+// HandleBatch posts the messages as a json array and expects a json array of item results in return.
+func (h *httpHandler) HandleBatch(ctx context.Context, source string, messages []v1.Message) ([]*BatchResult, HandlerError) {
+	items := make([]*wireMessage, len(messages))
+	for i, m := range messages {
+		items[i] = newWireMessage(m.Id(), m.Data(), m.Metadata())
+	}
+	body, err := json.Marshal(items)
+	if err != nil {
+		return nil, BadRequestError(err)
+	}
+	res, err := h.client.Post().
+		AddHeader("x-dqd-source", source).
+		SetHeader("Content-Type", defaultContentType).
+		Body(bytes.NewReader(body)).
+		Send()
+	if err != nil {
+		return nil, ServerError(err)
+	}
+	if handlerErr := responseError(res); handlerErr != nil {
+		return nil, handlerErr
+	}
+
+	var replies []*wireMessage
+	if err = res.JSON(&replies); err != nil {
+		return nil, ServerError(fmt.Errorf("invalid batch response: %w", err))
+	}
+	byId := map[string]*wireMessage{}
+	for _, r := range replies {
+		if r != nil && r.Id != "" {
+			byId[r.Id] = r
+		}
+	}
+	results := make([]*BatchResult, len(messages))
+	for i, m := range messages {
+		reply, ok := byId[m.Id()]
+		if !ok && i < len(replies) && replies[i] != nil && replies[i].Id == "" {
+			reply = replies[i]
+		}
+		if reply == nil {
+			results[i] = &BatchResult{Error: ServerError(fmt.Errorf("missing batch result for message %v", m.Id()))}
+			continue
+		}
+		message, handlerErr := reply.result()
+		results[i] = &BatchResult{Message: message, Error: handlerErr}
+	}
+	return results, nil
+}
+
+// responseError classifies failed handler responses.
+func responseError(res *gentleman.Response) HandlerError {
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		if retryAfter := parseRetryAfter(res.Header.Get("Retry-After")); retryAfter > 0 || res.StatusCode == http.StatusTooManyRequests {
+			return ThrottledError(res.StatusCode, retryAfter, fmt.Errorf("handler throttled: %d", res.StatusCode))
+		}
+	}
+	if res.ServerError {
+		return StatusError(res.StatusCode, fmt.Errorf("invalid server response: %d", res.StatusCode))
+	}
+	if res.ClientError {
+		return StatusError(res.StatusCode, fmt.Errorf("invalid client response: %d", res.StatusCode))
+	}
+	return nil
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an http date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
 func NewHttpHandler(options *HttpHandlerOptions) Handler {
 	client := gentleman.New().
 		URL(options.Endpoint).
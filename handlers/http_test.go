@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter(""); d != 0 {
+		t.Fatalf("expected no delay without a header, got %v", d)
+	}
+	if d := parseRetryAfter("120"); d != 2*time.Minute {
+		t.Fatalf("expected seconds to be parsed, got %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Fatalf("expected invalid values to be ignored, got %v", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d <= 50*time.Second || d > time.Minute {
+		t.Fatalf("expected the delay until the date, got %v", d)
+	}
+	past := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(past); d > 0 {
+		t.Fatalf("expected no delay for past dates, got %v", d)
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	var requests []wireMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-dqd-source") != "source" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&requests)
+		// Replies are matched by id, so they may come in any order and some may be missing
+		w.Write([]byte(`[{"id":"3","status":422,"error":"invalid"},{"id":"1","body":{"ok":true},"status":201}]`))
+	}))
+	defer server.Close()
+
+	h := NewHttpHandler(&HttpHandlerOptions{Endpoint: server.URL, Method: "POST"}).(BatchHandler)
+	messages := []v1.Message{
+		&testMessage{id: "1", data: []byte(`{"a":1}`)},
+		&testMessage{id: "2", data: []byte("text")},
+		&testMessage{id: "3", data: []byte(`{}`)},
+	}
+	results, err := h.HandleBatch(context.Background(), "source", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 || string(requests[0].Body) != `{"a":1}` || string(requests[1].Data) != "text" {
+		t.Fatalf("expected the messages to be posted as a json array, got %v", requests)
+	}
+	if results[0].Error != nil || string(results[0].Message.Data) != `{"ok":true}` || results[0].Message.Metadata[v1.MetadataStatusCode] != "201" {
+		t.Fatalf("expected the reply of message 1, got %v", results[0])
+	}
+	if results[1].Error == nil || results[1].Error.Code() != 5 {
+		t.Fatalf("expected a missing reply to fail message 2, got %v", results[1].Error)
+	}
+	if results[2].Error == nil || results[2].Error.Status() != 422 {
+		t.Fatalf("expected the failed reply of message 3, got %v", results[2].Error)
+	}
+}
+
+func TestHandleBatchFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	h := NewHttpHandler(&HttpHandlerOptions{Endpoint: server.URL, Method: "POST"}).(BatchHandler)
+	if _, err := h.HandleBatch(context.Background(), "source", []v1.Message{&testMessage{id: "1"}}); err == nil || err.Status() != 500 {
+		t.Fatalf("expected the whole batch to fail, got %v", err)
+	}
+}
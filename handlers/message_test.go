@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"context"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type testMessage struct {
+	id       string
+	data     []byte
+	metadata v1.Metadata
+}
+
+func (m *testMessage) Id() string            { return m.id }
+func (m *testMessage) Data() []byte          { return m.data }
+func (m *testMessage) Metadata() v1.Metadata { return m.metadata }
+func (m *testMessage) Complete() error       { return nil }
+func (m *testMessage) Abort(error) bool      { return true }
+
+func handleMessage(h Handler, m v1.Message) (*v1.RawMessage, HandlerError) {
+	return h.Handle(v1.CreateRequestContext(context.Background(), "test", m), m)
+}
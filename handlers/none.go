@@ -12,7 +12,10 @@ func (h *noneHandler) Available() error {
 }
 
 func (h *noneHandler) Handle(ctx *v1.RequestContext, message v1.Message) (*v1.RawMessage, HandlerError) {
-	return &v1.RawMessage{message.Data()}, nil
+	return &v1.RawMessage{
+		Data:     message.Data(),
+		Metadata: message.Metadata(),
+	}, nil
 }
 
 func (h *noneHandler) HealthStatus() v1.HealthStatus {
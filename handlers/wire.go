@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strconv"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// wireMessage is the json form of a message exchanged with batch and command handlers.
+// JSON payloads are embedded in body, other payloads are base64 encoded in data.
+type wireMessage struct {
+	Id       string          `json:"id,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Data     []byte          `json:"data,omitempty"`
+	Metadata v1.Metadata     `json:"metadata,omitempty"`
+	Status   int             `json:"status,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func newWireMessage(id string, data []byte, metadata v1.Metadata) *wireMessage {
+	m := &wireMessage{
+		Id:       id,
+		Metadata: metadata,
+	}
+	if json.Valid(data) {
+		m.Body = data
+	} else {
+		m.Data = data
+	}
+	return m
+}
+
+func (m *wireMessage) payload() []byte {
+	if m.Body != nil {
+		return m.Body
+	}
+	return m.Data
+}
+
+// result converts a handler reply to a handler result, replies with an error or a failure status are errors.
+func (m *wireMessage) result() (*v1.RawMessage, HandlerError) {
+	if m.Error != "" || m.Status >= 400 {
+		status := m.Status
+		if status < 400 {
+			status = 500
+		}
+		return nil, StatusError(status, &replyError{m.Error, status})
+	}
+	metadata := m.Metadata
+	if m.Status != 0 {
+		metadata = metadata.Copy()
+		metadata[v1.MetadataStatusCode] = strconv.Itoa(m.Status)
+	}
+	return &v1.RawMessage{
+		Data:     m.payload(),
+		Metadata: metadata,
+	}, nil
+}
+
+type replyError struct {
+	message string
+	status  int
+}
+
+func (e *replyError) Error() string {
+	if e.message == "" {
+		return "handler replied with status " + strconv.Itoa(e.status)
+	}
+	return e.message
+}
@@ -1,60 +1,54 @@
 package health
 
-import v1 "github.com/soluto/dqd/v1"
+import (
+	"sync"
+
+	v1 "github.com/soluto/dqd/v1"
+)
 
 type Probe struct {
-	inputs chan struct {
-		v1.HealthStatus
-		string
-	}
-	checks chan struct {
-		v1.HealthChecker
-		string
-	}
-	current v1.HealthStatus
+	lock     sync.Mutex
+	current  v1.HealthStatus
+	checkers map[string]v1.HealthChecker
 }
 
 func (p *Probe) UpdateStatus(status v1.HealthStatus, prefix string) {
-	p.inputs <- struct {
-		v1.HealthStatus
-		string
-	}{status, prefix}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.current.Add(status, prefix)
 }
 
 func (p *Probe) SendCheck(checker v1.HealthChecker, prefix string) {
-	p.checks <- struct {
-		v1.HealthChecker
-		string
-	}{checker, prefix}
+	p.UpdateStatus(checker.HealthStatus(), prefix)
 }
 
-func (p *Probe) HealthStatus() v1.HealthStatus {
-	return p.current
+// Register adds a checker whose status is read whenever the probe status is read.
+func (p *Probe) Register(checker v1.HealthChecker, prefix string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.checkers[prefix] = checker
 }
 
-func (p *Probe) run() {
-	for {
-		select {
-		case m := <-p.checks:
-			p.current.Add(m.HealthChecker.HealthStatus(), m.string)
-		case m := <-p.inputs:
-			p.current.Add(m.HealthStatus, m.string)
-		}
+func (p *Probe) HealthStatus() v1.HealthStatus {
+	p.lock.Lock()
+	status := v1.HealthStatus{}
+	for k, v := range p.current {
+		status[k] = v
+	}
+	checkers := make(map[string]v1.HealthChecker, len(p.checkers))
+	for prefix, checker := range p.checkers {
+		checkers[prefix] = checker
+	}
+	p.lock.Unlock()
+	for prefix, checker := range checkers {
+		status.Add(checker.HealthStatus(), prefix)
 	}
+	return status
 }
 
 func MakeProbe() *Probe {
-	p := &Probe{
-		inputs: make(chan struct {
-			v1.HealthStatus
-			string
-		}),
-		checks: make(chan struct {
-			v1.HealthChecker
-			string
-		}),
-		current: v1.HealthStatus{},
+	return &Probe{
+		current:  v1.HealthStatus{},
+		checkers: map[string]v1.HealthChecker{},
 	}
-	go p.run()
-	return p
 }
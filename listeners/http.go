@@ -36,7 +36,8 @@ func (h *HttpListener) Add(source *v1.Source, options *viper.Viper) {
 			return
 		}
 		err = p.Produce(r.Context(), &v1.RawMessage{
-			Data: string(msg),
+			Data:     msg,
+			Metadata: v1.MetadataFromHeaders(r.Header),
 		})
 		if err != nil {
 			logger.Warn().Err(err).Msg("Error producing item")
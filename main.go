@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -26,6 +27,16 @@ func GetHealthChecker(workers []*pipe.Worker) v1.HealthChecker {
 	return v1.CombineHealthCheckers(checkers)
 }
 
+// GetLivenessChecker reports the pipes and listeners that stopped.
+func GetLivenessChecker(workers []*pipe.Worker, listeners v1.HealthChecker) v1.HealthChecker {
+	checkers := make(map[string]v1.HealthChecker)
+	for _, w := range workers {
+		checkers[w.Name] = v1.HealthCheckerFunc(w.Liveness)
+	}
+	checkers["listeners"] = listeners
+	return v1.CombineHealthCheckers(checkers)
+}
+
 func main() {
 	conf, err := cmd.Load()
 	if err != nil {
@@ -33,6 +44,7 @@ func main() {
 	}
 	conf.SetDefault("logLevel", 1)
 	conf.SetDefault("apiPort", 8888)
+	conf.SetDefault("drainTimeout", "30s")
 	logLevel := conf.GetInt("logLevel")
 	zerolog.SetGlobalLevel(zerolog.Level(logLevel))
 
@@ -48,20 +60,24 @@ func main() {
 
 	ctx := utils.ContextWithSignal(context.Background())
 
+	var workers sync.WaitGroup
 	for _, worker := range app.Workers {
+		workers.Add(1)
 		go func(worker *pipe.Worker) {
-			err := worker.Start(ctx)
-			if err != nil {
-				panic(err)
+			defer workers.Done()
+			// A pipe that stopped is reported by /live, the other pipes keep running
+			if err := worker.Start(ctx); err != nil {
+				logger.Error().Err(err).Str("pipe", worker.Name).Msg("Pipe stopped")
 			}
 		}(worker)
 	}
 
+	listenersHealth := &v1.HealthTracker{}
 	for _, listener := range app.Listeners {
 		go func(listener listeners.Listener) {
-			err := listener.Listen(ctx)
-			if err != nil {
-				panic(err)
+			if err := listener.Listen(ctx); err != nil {
+				logger.Error().Err(err).Msg("Listener stopped")
+				listenersHealth.Track(err)
 			}
 		}(listener)
 	}
@@ -70,10 +86,11 @@ func main() {
 		cmd.ConfigurationError(fmt.Errorf("no workers or sources are defiend"))
 	}
 
-	go api.Start(ctx, apiPort, GetHealthChecker(app.Workers))
+	go api.Start(ctx, apiPort, GetHealthChecker(app.Workers), GetLivenessChecker(app.Workers, listenersHealth))
 
 	select {
 	case <-ctx.Done():
 		logger.Info().Msg("Shutting Down")
 	}
+	workers.Wait()
 }
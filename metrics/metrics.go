@@ -25,6 +25,43 @@ var WorkerBatchSizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 	Help:      "concurrent message handling",
 }, []string{"source"})
 
+var WorkerInflightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "worker",
+	Subsystem: "concurrent",
+	Name:      "inflight",
+	Help:      "messages currently handled",
+}, []string{"pipe"})
+
+var WorkerQueueingDelayHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "worker",
+	Name:      "queueing_delay",
+	Help:      "time messages wait for a free concurrency slot",
+}, []string{"pipe", "source"})
+
+var WorkerThrottledTimeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "worker",
+	Name:      "throttled_seconds",
+	Help:      "time messages were held by the throughput limit",
+}, []string{"pipe", "source"})
+
+var WorkerFilteredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "worker",
+	Name:      "filtered",
+	Help:      "messages that didn't match the pipe filter",
+}, []string{"pipe", "source", "action"})
+
+var WorkerRoutedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "worker",
+	Name:      "routed",
+	Help:      "handler responses written to router destinations",
+}, []string{"pipe", "destination", "success"})
+
+var WorkerDuplicatesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "worker",
+	Name:      "duplicates",
+	Help:      "duplicate messages that weren't handled, completed when already processed and aborted while in flight",
+}, []string{"pipe", "source", "outcome"})
+
 var HandlerProcessingHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 	Namespace: "worker",
 	Name:      "handler_processing",
@@ -51,6 +88,12 @@ func Start(metricsPort int) {
 		PipeProcessingMessagesHistogram,
 		WorkerBatchSizeGauge,
 		WorkerMaxConcurrencyGauge,
+		WorkerInflightGauge,
+		WorkerQueueingDelayHistogram,
+		WorkerThrottledTimeCounter,
+		WorkerFilteredCounter,
+		WorkerRoutedCounter,
+		WorkerDuplicatesCounter,
 	)
 
 	http.Handle("/metrics", promhttp.Handler())
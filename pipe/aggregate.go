@@ -0,0 +1,110 @@
+package pipe
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// Aggregate groups handler responses by key, a group is written to the output as a json array once it has Size
+// responses or Window has passed since its first response.
+type Aggregate struct {
+	Key    *utils.KeyExpression
+	Size   int
+	Window time.Duration
+}
+
+type aggregateGroup struct {
+	key       string
+	requests  []*v1.RequestContext
+	responses []*v1.RawMessage
+	done      chan struct{}
+	err       error
+}
+
+type aggregator struct {
+	*Aggregate
+	lock    sync.Mutex
+	groups  map[string]*aggregateGroup
+	produce func(ctx *v1.RequestContext, m *v1.RawMessage) error
+}
+
+func newAggregator(aggregate *Aggregate, produce func(ctx *v1.RequestContext, m *v1.RawMessage) error) *aggregator {
+	return &aggregator{
+		Aggregate: aggregate,
+		groups:    map[string]*aggregateGroup{},
+		produce:   produce,
+	}
+}
+
+// add adds the response to its group and waits until the group was written, it returns the write error.
+func (a *aggregator) add(ctx *v1.RequestContext, m *v1.RawMessage) error {
+	var key string
+	if a.Key != nil {
+		key, _ = a.Key.Evaluate(ctx.Message().Id(), m.Data, m.Metadata)
+	}
+	a.lock.Lock()
+	g, ok := a.groups[key]
+	if !ok {
+		g = &aggregateGroup{key: key, done: make(chan struct{})}
+		a.groups[key] = g
+		time.AfterFunc(a.Window, func() { a.flush(g) })
+	}
+	g.requests = append(g.requests, ctx)
+	g.responses = append(g.responses, m)
+	full := a.Size > 0 && len(g.responses) >= a.Size
+	a.lock.Unlock()
+
+	if full {
+		a.flush(g)
+	}
+	<-g.done
+	return g.err
+}
+
+// flush writes the group unless it was already written.
+func (a *aggregator) flush(g *aggregateGroup) {
+	a.lock.Lock()
+	if a.groups[g.key] != g {
+		a.lock.Unlock()
+		return
+	}
+	delete(a.groups, g.key)
+	a.lock.Unlock()
+
+	items := make([]json.RawMessage, len(g.responses))
+	for i, m := range g.responses {
+		if json.Valid(m.Data) {
+			items[i] = m.Data
+		} else {
+			items[i], _ = json.Marshal(string(m.Data))
+		}
+	}
+	data, err := json.Marshal(items)
+	if err == nil {
+		metadata := v1.Metadata{v1.MetadataContentType: "application/json"}
+		if g.key != "" {
+			metadata[v1.MetadataGroupId] = g.key
+		}
+		err = a.produce(g.requests[0], &v1.RawMessage{Data: data, Metadata: metadata})
+	}
+	g.err = err
+	close(g.done)
+}
+
+// extendWhileParked keeps the lease of a message waiting for its group using the pipe heartbeat,
+// without a heartbeat the lease is extended once.
+func (w *Worker) extendWhileParked(r *v1.RequestContext) (stop func()) {
+	if w.heartbeatInterval > 0 {
+		return w.startHeartbeat(r)
+	}
+	if extender, ok := r.Message().(v1.LeaseExtender); ok {
+		if err := extender.ExtendLease(); err != nil {
+			w.logger.Warn().Err(err).Str("source", r.Source()).Msg("Failed to extend message lease")
+		}
+	}
+	return func() {}
+}
@@ -0,0 +1,102 @@
+package pipe
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type producedGroups struct {
+	lock   sync.Mutex
+	groups []*v1.RawMessage
+	err    error
+}
+
+func (p *producedGroups) produce(ctx *v1.RequestContext, m *v1.RawMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.groups = append(p.groups, m)
+	return p.err
+}
+
+func addAll(a *aggregator, responses ...*v1.RawMessage) []error {
+	errs := make([]error, len(responses))
+	var wg sync.WaitGroup
+	for i, m := range responses {
+		wg.Add(1)
+		go func(i int, m *v1.RawMessage) {
+			defer wg.Done()
+			errs[i] = a.add(newTestRequest(newTestMessage("1", "{}")), m)
+		}(i, m)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestAggregatorWritesFullGroups(t *testing.T) {
+	key, err := utils.ParseKeyExpression("body.user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &producedGroups{}
+	a := newAggregator(&Aggregate{Key: key, Size: 2, Window: time.Minute}, p.produce)
+
+	errs := addAll(a,
+		&v1.RawMessage{Data: []byte(`{"user":"a","n":1}`)},
+		&v1.RawMessage{Data: []byte(`{"user":"b","n":2}`)},
+		&v1.RawMessage{Data: []byte(`{"user":"a","n":3}`)},
+		&v1.RawMessage{Data: []byte(`{"user":"b","n":4}`)},
+	)
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(p.groups) != 2 {
+		t.Fatalf("expected a group per user, got %v", len(p.groups))
+	}
+	for _, g := range p.groups {
+		var items []map[string]interface{}
+		if err := json.Unmarshal(g.Data, &items); err != nil {
+			t.Fatal(err)
+		}
+		user := g.Metadata[v1.MetadataGroupId]
+		if len(items) != 2 || items[0]["user"] != user || items[1]["user"] != user {
+			t.Fatalf("expected 2 responses of user %v, got %s", user, g.Data)
+		}
+		if g.Metadata[v1.MetadataContentType] != "application/json" {
+			t.Fatalf("expected a json group, got %v", g.Metadata)
+		}
+	}
+}
+
+func TestAggregatorWritesGroupsAfterWindow(t *testing.T) {
+	p := &producedGroups{err: errors.New("failed")}
+	a := newAggregator(&Aggregate{Size: 10, Window: 20 * time.Millisecond}, p.produce)
+
+	start := time.Now()
+	errs := addAll(a, &v1.RawMessage{Data: []byte(`{"n":1}`)}, &v1.RawMessage{Data: []byte("text")})
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected the group to wait for the window, waited %v", elapsed)
+	}
+	for _, err := range errs {
+		if err == nil {
+			t.Fatal("expected the write error to be returned to every response")
+		}
+	}
+	if len(p.groups) != 1 {
+		t.Fatalf("expected a single group, got %v", len(p.groups))
+	}
+	var items []interface{}
+	if err := json.Unmarshal(p.groups[0].Data, &items); err != nil || len(items) != 2 {
+		t.Fatalf("expected non json responses to be written as strings, got %s", p.groups[0].Data)
+	}
+	if _, ok := p.groups[0].Metadata[v1.MetadataGroupId]; ok {
+		t.Fatal("expected groups without a key not to have a group id")
+	}
+}
@@ -0,0 +1,154 @@
+package pipe
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/soluto/dqd/handlers"
+	"github.com/soluto/dqd/metrics"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// batch groups messages of each source until the batch size is reached or the batch window has passed since its first message.
+func (w *Worker) batch(ctx context.Context, messages chan *v1.RequestContext, batches chan []*v1.RequestContext) {
+	pending := map[string][]*v1.RequestContext{}
+	deadlines := map[string]time.Time{}
+
+	flush := func(source string) bool {
+		batch := pending[source]
+		delete(pending, source)
+		delete(deadlines, source)
+		select {
+		case <-ctx.Done():
+			return false
+		case batches <- batch:
+			return true
+		}
+	}
+
+	for {
+		var timeout <-chan time.Time
+		var next time.Time
+		for _, d := range deadlines {
+			if next.IsZero() || d.Before(next) {
+				next = d
+			}
+		}
+		if !next.IsZero() {
+			timeout = time.After(time.Until(next))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-messages:
+			source := m.Source()
+			if w.throttle(ctx, w.throughput, source) != nil {
+				return
+			}
+			if len(pending[source]) == 0 {
+				deadlines[source] = time.Now().Add(w.batchWindow)
+			}
+			pending[source] = append(pending[source], m)
+			if len(pending[source]) >= w.batchSize && !flush(source) {
+				return
+			}
+		case <-timeout:
+			now := time.Now()
+			for source, d := range deadlines {
+				if !d.After(now) && !flush(source) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// dispatchBatches sends every batch to the handler, a batch takes a single concurrency slot.
+func (w *Worker) dispatchBatches(ctx context.Context, messages chan *v1.RequestContext, results chan *v1.RequestContext) {
+	inflightGauge := metrics.WorkerInflightGauge.WithLabelValues(w.Name)
+	batches := make(chan []*v1.RequestContext)
+	go w.batch(ctx, messages, batches)
+
+	for {
+		var batch []*v1.RequestContext
+		select {
+		case <-ctx.Done():
+			return
+		case batch = <-batches:
+		}
+		source := batch[0].Source()
+		if w.waitForPause(ctx, source) != nil {
+			return
+		}
+		if w.pool.Acquire(ctx) != nil {
+			return
+		}
+		for _, r := range batch {
+			metrics.WorkerQueueingDelayHistogram.WithLabelValues(w.Name, source).Observe(time.Since(r.DequeueTime()).Seconds())
+		}
+		inflightGauge.Add(float64(len(batch)))
+
+		go func(batch []*v1.RequestContext) {
+			stops := make([]func(), len(batch))
+			for i, r := range batch {
+				stops[i] = w.startHeartbeat(r)
+			}
+			w.handleBatch(ctx, source, batch)
+			for _, stop := range stops {
+				stop()
+			}
+			w.pool.Release()
+			inflightGauge.Sub(float64(len(batch)))
+			for _, r := range batch {
+				select {
+				case <-ctx.Done():
+				case results <- r:
+				}
+			}
+		}(batch)
+	}
+}
+
+// handleBatch sets the result of every request in the batch, requests that can't be transformed aren't sent to the handler.
+func (w *Worker) handleBatch(ctx context.Context, source string, batch []*v1.RequestContext) {
+	var messages []v1.Message
+	var handled []int
+	for i, r := range batch {
+		if err := w.reserve(r); err != nil {
+			batch[i] = r.WithResult(nil, err)
+			continue
+		}
+		request, err := w.transformRequest(r.Request())
+		if err != nil {
+			batch[i] = r.WithAttempts(1).WithResult(nil, err)
+			continue
+		}
+		messages = append(messages, request)
+		handled = append(handled, i)
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	start := time.Now()
+	results, err := w.handler.(handlers.BatchHandler).HandleBatch(ctx, source, messages)
+
+	t := float64(time.Since(start)) / float64(time.Second)
+	metrics.HandlerProcessingHistogram.WithLabelValues(w.Name, source, strconv.FormatBool(err == nil)).Observe(t)
+	w.window.observe(time.Since(start), w.pool.Active(), handlers.IsBackpressure(err))
+
+	for j, i := range handled {
+		r := batch[i].WithAttempts(1)
+		if err != nil {
+			batch[i] = r.WithResult(nil, err)
+			continue
+		}
+		result, resultErr := results[j].Message, error(results[j].Error)
+		if resultErr == nil && result != nil {
+			result, resultErr = w.transformResponse(result)
+		}
+		batch[i] = r.WithResult(result, resultErr)
+	}
+}
@@ -0,0 +1,156 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soluto/dqd/handlers"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// testBatchHandler fails the messages with a "fail" body and replies with the others.
+type testBatchHandler struct {
+	batches [][]v1.Message
+}
+
+func (h *testBatchHandler) HealthStatus() v1.HealthStatus {
+	return v1.NewHealthStatus(v1.Healthy)
+}
+
+func (h *testBatchHandler) Handle(*v1.RequestContext, v1.Message) (*v1.RawMessage, handlers.HandlerError) {
+	return nil, handlers.ServerError(errors.New("unexpected single message call"))
+}
+
+func (h *testBatchHandler) HandleBatch(_ context.Context, _ string, messages []v1.Message) ([]*handlers.BatchResult, handlers.HandlerError) {
+	h.batches = append(h.batches, messages)
+	results := make([]*handlers.BatchResult, len(messages))
+	for i, m := range messages {
+		if string(m.Data()) == "fail" {
+			results[i] = &handlers.BatchResult{Error: handlers.ServerError(errors.New("failed"))}
+			continue
+		}
+		results[i] = &handlers.BatchResult{Message: &v1.RawMessage{Data: []byte("reply-" + m.Id())}}
+	}
+	return results, nil
+}
+
+func newBatchTestWorker(size int, batchWindow time.Duration) (*Worker, *testBatchHandler) {
+	h := &testBatchHandler{}
+	w := newTestWorker(WithBatch(size, batchWindow))
+	w.handler = h
+	w.pool = newPool(1)
+	return w, h
+}
+
+func receiveBatch(t *testing.T, batches chan []*v1.RequestContext, timeout time.Duration) []*v1.RequestContext {
+	t.Helper()
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(timeout):
+		t.Fatal("expected a batch to be flushed")
+		return nil
+	}
+}
+
+func TestBatchFlushesOnSize(t *testing.T) {
+	w, _ := newBatchTestWorker(3, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, batches := make(chan *v1.RequestContext), make(chan []*v1.RequestContext)
+	go w.batch(ctx, messages, batches)
+
+	for _, id := range []string{"1", "2", "3"} {
+		messages <- newTestRequest(newTestMessage(id, "{}"))
+	}
+	batch := receiveBatch(t, batches, time.Second)
+	if len(batch) != 3 || batch[0].Message().Id() != "1" || batch[2].Message().Id() != "3" {
+		t.Fatalf("expected the first 3 messages to be flushed, got %v messages", len(batch))
+	}
+	messages <- newTestRequest(newTestMessage("4", "{}"))
+	select {
+	case batch = <-batches:
+		t.Fatalf("expected the 4th message to wait for the window, got a batch of %v", len(batch))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBatchFlushesOnWindow(t *testing.T) {
+	w, _ := newBatchTestWorker(10, 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, batches := make(chan *v1.RequestContext), make(chan []*v1.RequestContext)
+	go w.batch(ctx, messages, batches)
+
+	start := time.Now()
+	messages <- newTestRequest(newTestMessage("1", "{}"))
+	messages <- v1.CreateRequestContext(context.Background(), "other", newTestMessage("2", "{}"))
+	messages <- newTestRequest(newTestMessage("3", "{}"))
+	first := receiveBatch(t, batches, time.Second)
+	second := receiveBatch(t, batches, time.Second)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("expected the batches to be flushed once the window passed")
+	}
+	if first[0].Source() == "other" {
+		first, second = second, first
+	}
+	if len(first) != 2 || len(second) != 1 || second[0].Source() != "other" {
+		t.Fatalf("expected a batch per source, got %v and %v messages", len(first), len(second))
+	}
+}
+
+func TestHandleBatchMapsResults(t *testing.T) {
+	w, h := newBatchTestWorker(10, time.Second)
+	batch := []*v1.RequestContext{
+		newTestRequest(newTestMessage("1", "{}")),
+		newTestRequest(newTestMessage("2", "fail")),
+		newTestRequest(newTestMessage("3", "{}")),
+	}
+	w.handleBatch(context.Background(), "source", batch)
+
+	if len(h.batches) != 1 || len(h.batches[0]) != 3 {
+		t.Fatalf("expected a single call with the 3 messages, got %v", h.batches)
+	}
+	for i, id := range []string{"1", "3"} {
+		m, err := batch[i*2].Result()
+		if err != nil || string(m.Data) != "reply-"+id {
+			t.Fatalf("expected message %v to get its reply, got %v %v", id, m, err)
+		}
+	}
+	if _, err := batch[1].Result(); err == nil {
+		t.Fatal("expected the failed item to get its error")
+	}
+	for _, r := range batch {
+		if r.Attempts() != 1 {
+			t.Fatalf("expected the handled messages to have an attempt, got %v", r.Attempts())
+		}
+	}
+}
+
+func TestBatchPartialFailureSettlesEachMessage(t *testing.T) {
+	w, _ := newBatchTestWorker(10, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := []*testMessage{newTestMessage("1", "{}"), newTestMessage("2", "fail"), newTestMessage("3", "{}")}
+	batch := make([]*v1.RequestContext, len(messages))
+	for i, m := range messages {
+		batch[i] = newTestRequest(m)
+	}
+	w.handleBatch(ctx, "source", batch)
+
+	results := make(chan *v1.RequestContext)
+	go w.handleResults(ctx, results)
+	w.inflight.Add(len(batch))
+	for _, r := range batch {
+		results <- r
+	}
+	w.inflight.Wait()
+
+	for i, expected := range [][2]int{{1, 0}, {0, 1}, {1, 0}} {
+		if completed, aborted := messages[i].settled(); completed != expected[0] || aborted != expected[1] {
+			t.Fatalf("expected message %v to be completed %v and aborted %v times, got %v and %v", messages[i].id, expected[0], expected[1], completed, aborted)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package pipe
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type coalesced struct {
+	item interface{}
+	done chan error
+}
+
+// coalescer groups calls made within a window into a single batch call.
+type coalescer struct {
+	ctx      context.Context
+	size     int
+	window   time.Duration
+	flush    func(items []interface{}) []error
+	single   func(item interface{}) error
+	requests chan *coalesced
+}
+
+func newCoalescer(ctx context.Context, size int, window time.Duration, flush func([]interface{}) []error, single func(interface{}) error) *coalescer {
+	c := &coalescer{
+		ctx:      ctx,
+		size:     size,
+		window:   window,
+		flush:    flush,
+		single:   single,
+		requests: make(chan *coalesced),
+	}
+	go c.run()
+	return c
+}
+
+// do adds the item to the next batch and waits for its result, items are handled one at a time once ctx is done.
+func (c *coalescer) do(item interface{}) error {
+	r := &coalesced{item, make(chan error, 1)}
+	select {
+	case <-c.ctx.Done():
+		return c.single(item)
+	case c.requests <- r:
+	}
+	return <-r.done
+}
+
+func (c *coalescer) run() {
+	for {
+		var batch []*coalesced
+		select {
+		case <-c.ctx.Done():
+			return
+		case r := <-c.requests:
+			batch = append(batch, r)
+		}
+		timeout := time.After(c.window)
+	Collect:
+		for len(batch) < c.size {
+			select {
+			case r := <-c.requests:
+				batch = append(batch, r)
+			case <-timeout:
+				break Collect
+			case <-c.ctx.Done():
+				break Collect
+			}
+		}
+		go c.send(batch)
+	}
+}
+
+func (c *coalescer) send(batch []*coalesced) {
+	items := make([]interface{}, len(batch))
+	for i, r := range batch {
+		items[i] = r.item
+	}
+	errs := c.flush(items)
+	for i, r := range batch {
+		r.done <- errs[i]
+	}
+}
+
+func newCompleteCoalescer(ctx context.Context, completer v1.BatchCompleter, size int, window time.Duration) *coalescer {
+	return newCoalescer(ctx, size, window, func(items []interface{}) []error {
+		messages := make([]v1.Message, len(items))
+		for i, item := range items {
+			messages[i] = item.(v1.Message)
+		}
+		return completer.CompleteBatch(messages)
+	}, func(item interface{}) error {
+		return item.(v1.Message).Complete()
+	})
+}
+
+// coalescingProducer sends messages produced within the coalescing window in a single batch.
+type coalescingProducer struct {
+	v1.Producer
+	coalescer *coalescer
+}
+
+func (p *coalescingProducer) Produce(ctx context.Context, m *v1.RawMessage) error {
+	return p.coalescer.do(m)
+}
+
+func (w *Worker) coalesceProducer(ctx context.Context, p v1.Producer) v1.Producer {
+	batchProducer, ok := p.(v1.BatchProducer)
+	if !ok || w.coalesceWindow <= 0 {
+		return p
+	}
+	return &coalescingProducer{
+		Producer: p,
+		coalescer: newCoalescer(ctx, w.coalesceSize, w.coalesceWindow, func(items []interface{}) []error {
+			messages := make([]*v1.RawMessage, len(items))
+			for i, item := range items {
+				messages[i] = item.(*v1.RawMessage)
+			}
+			return batchProducer.ProduceBatch(ctx, messages)
+		}, func(item interface{}) error {
+			return p.Produce(ctx, item.(*v1.RawMessage))
+		}),
+	}
+}
+
+// complete completes the request message, coalescing completes when the source consumer supports batches.
+// Split messages are completed by their parent once all of the items were completed.
+func (w *Worker) complete(ctx *v1.RequestContext) error {
+	if _, ok := ctx.Message().(*splitMessage); ok {
+		return ctx.Complete()
+	}
+	if c, ok := w.completers[ctx.Source()]; ok {
+		return c.do(ctx.Message())
+	}
+	return ctx.Complete()
+}
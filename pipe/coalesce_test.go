@@ -0,0 +1,103 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingFlush records the batches it was called with, items equal to "fail" fail.
+type recordingFlush struct {
+	lock    sync.Mutex
+	batches [][]interface{}
+	singles []interface{}
+}
+
+func (r *recordingFlush) flush(items []interface{}) []error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.batches = append(r.batches, items)
+	errs := make([]error, len(items))
+	for i, item := range items {
+		if item == "fail" {
+			errs[i] = errors.New("failed")
+		}
+	}
+	return errs
+}
+
+func (r *recordingFlush) single(item interface{}) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.singles = append(r.singles, item)
+	return nil
+}
+
+func doAll(c *coalescer, items ...interface{}) []error {
+	errs := make([]error, len(items))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item interface{}) {
+			defer wg.Done()
+			errs[i] = c.do(item)
+		}(i, item)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestCoalescerBatchesUpToSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &recordingFlush{}
+	c := newCoalescer(ctx, 2, time.Minute, r.flush, r.single)
+
+	errs := doAll(c, "a", "fail", "b", "c")
+	failures := 0
+	for _, err := range errs {
+		if err != nil {
+			failures++
+		}
+	}
+	if failures != 1 || errs[1] == nil {
+		t.Fatalf("expected only the failed item to fail, got %v", errs)
+	}
+	if len(r.batches) != 2 || len(r.batches[0]) != 2 || len(r.batches[1]) != 2 {
+		t.Fatalf("expected 2 full batches, got %v", r.batches)
+	}
+}
+
+func TestCoalescerFlushesAfterWindow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &recordingFlush{}
+	c := newCoalescer(ctx, 10, 20*time.Millisecond, r.flush, r.single)
+
+	start := time.Now()
+	if err := c.do("a"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expected the batch to wait for the window, waited %v", elapsed)
+	}
+	if len(r.batches) != 1 || len(r.batches[0]) != 1 {
+		t.Fatalf("expected a single batch of one item, got %v", r.batches)
+	}
+}
+
+func TestCoalescerHandlesItemsOneAtATimeOnceDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &recordingFlush{}
+	c := newCoalescer(ctx, 10, time.Minute, r.flush, r.single)
+	cancel()
+
+	if err := c.do("a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.singles) != 1 || len(r.batches) != 0 {
+		t.Fatalf("expected the item to be handled alone, got singles %v batches %v", r.singles, r.batches)
+	}
+}
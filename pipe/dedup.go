@@ -0,0 +1,108 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/soluto/dqd/dedup"
+	"github.com/soluto/dqd/metrics"
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// errDuplicate is the result of requests that were already processed, errInFlight of requests whose key is
+// reserved by a message that is being handled.
+var (
+	errDuplicate = errors.New("duplicate message")
+	errInFlight  = errors.New("duplicate message is being handled")
+)
+
+// Deduplication completes messages whose key was processed within TTL without handling them. The key is
+// reserved for ReserveTTL while the message is handled, duplicates delivered meanwhile are returned to the source.
+type Deduplication struct {
+	// Key defaults to the message id.
+	Key        *utils.KeyExpression
+	Store      dedup.Store
+	TTL        time.Duration
+	ReserveTTL time.Duration
+	// Timeout bounds store calls, requests are handled when the store doesn't respond in time.
+	Timeout time.Duration
+}
+
+func (d *Deduplication) key(m v1.Message) (string, bool) {
+	if d.Key == nil {
+		return m.Id(), m.Id() != ""
+	}
+	return d.Key.Evaluate(m.Id(), m.Data(), m.Metadata())
+}
+
+func (d *Deduplication) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.Timeout)
+}
+
+// reserve reserves the request key before it is handled, it returns errDuplicate when the key was processed and
+// errInFlight when it is reserved. Requests are handled when the store fails.
+func (w *Worker) reserve(r *v1.RequestContext) error {
+	if w.dedup == nil {
+		return nil
+	}
+	key, ok := w.dedup.key(r.Request())
+	if !ok {
+		return nil
+	}
+	ctx, cancel := w.dedup.context(r)
+	defer cancel()
+	reserved, err := w.dedup.Store.Reserve(ctx, key, w.dedup.ReserveTTL)
+	if err != nil {
+		w.logger.Warn().Err(err).Str("key", key).Msg("Failed to check duplicate message, handling it")
+		return nil
+	}
+	switch reserved {
+	case dedup.Processed:
+		return errDuplicate
+	case dedup.InFlight:
+		return errInFlight
+	}
+	return nil
+}
+
+// settleReservation marks the key of a processed request for the ttl, or releases it so the message can be handled again.
+func (w *Worker) settleReservation(r *v1.RequestContext, processed bool) {
+	if w.dedup == nil {
+		return
+	}
+	key, ok := w.dedup.key(r.Request())
+	if !ok {
+		return
+	}
+	ctx, cancel := w.dedup.context(r)
+	defer cancel()
+	var err error
+	if processed {
+		err = w.dedup.Store.Mark(ctx, key, w.dedup.TTL)
+	} else {
+		err = w.dedup.Store.Release(ctx, key)
+	}
+	if err != nil {
+		w.logger.Warn().Err(err).Str("key", key).Bool("processed", processed).Msg("Failed to update message deduplication key")
+	}
+}
+
+// settleDuplicate completes a processed duplicate message without calling the handler, duplicates of
+// messages that are being handled are aborted so they are checked again once the original settles.
+func (w *Worker) settleDuplicate(r *v1.RequestContext, err error) {
+	if err == errInFlight {
+		metrics.WorkerDuplicatesCounter.WithLabelValues(w.Name, r.Source(), "aborted").Inc()
+		r.Abort(err)
+		return
+	}
+	metrics.WorkerDuplicatesCounter.WithLabelValues(w.Name, r.Source(), "completed").Inc()
+	if err := w.complete(r); err != nil {
+		w.logger.Error().Err(err).Msg("Failed to complete duplicate message")
+		r.Abort(err)
+	}
+}
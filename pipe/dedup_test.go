@@ -0,0 +1,61 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/soluto/dqd/dedup"
+	"github.com/soluto/dqd/metrics"
+)
+
+func TestDeduplication(t *testing.T) {
+	w := newTestWorker(WithDeduplication(&Deduplication{
+		Store:      dedup.NewMemoryStore(10),
+		TTL:        time.Minute,
+		ReserveTTL: time.Minute,
+		Timeout:    time.Second,
+	}))
+
+	first := newTestRequest(newTestMessage("1", "{}"))
+	if err := w.reserve(first); err != nil {
+		t.Fatalf("expected the first delivery to be handled, got %v", err)
+	}
+	inFlight := newTestMessage("1", "{}")
+	if err := w.reserve(newTestRequest(inFlight)); err != errInFlight {
+		t.Fatalf("expected a delivery of a message being handled to be in flight, got %v", err)
+	}
+	w.settleDuplicate(newTestRequest(inFlight), errInFlight)
+	if completed, aborted := inFlight.settled(); completed != 0 || aborted != 1 {
+		t.Fatalf("expected the in flight duplicate to be returned to the source, got %v completes %v aborts", completed, aborted)
+	}
+
+	// A failed message is handled again
+	w.settleReservation(first, false)
+	if err := w.reserve(first); err != nil {
+		t.Fatalf("expected a released message to be handled, got %v", err)
+	}
+
+	w.settleReservation(first, true)
+	duplicate := newTestMessage("1", "{}")
+	if err := w.reserve(newTestRequest(duplicate)); err != errDuplicate {
+		t.Fatalf("expected a processed message to be a duplicate, got %v", err)
+	}
+	w.settleDuplicate(newTestRequest(duplicate), errDuplicate)
+	if completed, aborted := duplicate.settled(); completed != 1 || aborted != 0 {
+		t.Fatalf("expected the duplicate to be completed, got %v completes %v aborts", completed, aborted)
+	}
+}
+
+func TestDuplicatesOutcome(t *testing.T) {
+	w := newTestWorker()
+	counter := func(outcome string) float64 {
+		return testutil.ToFloat64(metrics.WorkerDuplicatesCounter.WithLabelValues(w.Name, "source", outcome))
+	}
+	aborted, completed := counter("aborted"), counter("completed")
+	w.settleDuplicate(newTestRequest(newTestMessage("1", "{}")), errInFlight)
+	w.settleDuplicate(newTestRequest(newTestMessage("2", "{}")), errDuplicate)
+	if counter("aborted") != aborted+1 || counter("completed") != completed+1 {
+		t.Fatal("expected in flight duplicates to be counted as aborted and processed duplicates as completed")
+	}
+}
@@ -0,0 +1,115 @@
+package pipe
+
+import (
+	"regexp"
+
+	"github.com/soluto/dqd/metrics"
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type FilterAction string
+
+const (
+	// FilterComplete completes messages that don't match the filter.
+	FilterComplete = FilterAction("complete")
+	// FilterSkip returns messages that don't match the filter to the source, for consumers with other filters.
+	FilterSkip = FilterAction("skip")
+	// FilterRoute writes messages that don't match the filter to another source and completes them.
+	FilterRoute = FilterAction("route")
+)
+
+// Condition checks a value of the message selected by a key expression.
+// All of the set checks must pass for the condition to match.
+type Condition struct {
+	Key     *utils.KeyExpression
+	Exists  *bool
+	In      []string
+	NotIn   []string
+	Matches *regexp.Regexp
+}
+
+type Filter struct {
+	Conditions []*Condition
+	// Any matches messages that match any of the conditions instead of all of them.
+	Any        bool
+	OnMismatch FilterAction
+	Source     *v1.Source
+}
+
+func (c *Condition) matches(id string, data []byte, metadata v1.Metadata) bool {
+	value, exists := c.Key.Evaluate(id, data, metadata)
+	if c.Exists != nil && *c.Exists != exists {
+		return false
+	}
+	if c.In != nil && (!exists || !contains(c.In, value)) {
+		return false
+	}
+	if c.NotIn != nil && exists && contains(c.NotIn, value) {
+		return false
+	}
+	if c.Matches != nil && (!exists || !c.Matches.MatchString(value)) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchConditions checks that all of the conditions match, or any of them when any is set.
+func matchConditions(conditions []*Condition, any bool, id string, data []byte, metadata v1.Metadata) bool {
+	for _, c := range conditions {
+		if c.matches(id, data, metadata) == any {
+			return any
+		}
+	}
+	return !any || len(conditions) == 0
+}
+
+func (f *Filter) matches(m v1.Message) bool {
+	return matchConditions(f.Conditions, f.Any, m.Id(), m.Data(), m.Metadata())
+}
+
+// handleMismatch completes, skips or routes a message that didn't match the filter without calling the handler.
+func (w *Worker) handleMismatch(ctx *v1.RequestContext, producer v1.Producer) {
+	defer w.inflight.Done()
+	metrics.WorkerFilteredCounter.WithLabelValues(w.Name, ctx.Source(), string(w.filter.OnMismatch)).Inc()
+	var err error
+	switch w.filter.OnMismatch {
+	case FilterSkip:
+		w.skip(ctx)
+		return
+	case FilterRoute:
+		m := ctx.Message()
+		if err = producer.Produce(ctx, &v1.RawMessage{Data: m.Data(), Metadata: m.Metadata()}); err != nil {
+			break
+		}
+		err = w.complete(ctx)
+	default:
+		err = w.complete(ctx)
+	}
+	if err != nil {
+		w.logger.Error().Err(err).Msg("Failed to handle filtered message")
+		ctx.Message().Abort(err)
+	}
+}
+
+// skip makes the message visible to other consumers right away, messages that can't be deferred are aborted.
+func (w *Worker) skip(ctx *v1.RequestContext) {
+	m := ctx.Message()
+	if d, ok := m.(v1.Deferrer); ok {
+		err := d.Defer(0)
+		if err == nil {
+			return
+		}
+		w.logger.Warn().Err(err).Msg("Failed to skip filtered message")
+	}
+	m.Abort(nil)
+}
@@ -0,0 +1,18 @@
+package pipe
+
+import "testing"
+
+func TestSkipDefersMessages(t *testing.T) {
+	w := newTestWorker()
+	m := &testDeferMessage{testMessage: newTestMessage("1", "{}")}
+	w.skip(newTestRequest(m))
+	if _, aborted := m.settled(); aborted != 0 || len(m.delays) != 1 || m.delays[0] != 0 {
+		t.Fatalf("expected the message to be deferred without a delay, got aborts %v delays %v", aborted, m.delays)
+	}
+
+	plain := newTestMessage("2", "{}")
+	w.skip(newTestRequest(plain))
+	if _, aborted := plain.settled(); aborted != 1 {
+		t.Fatalf("expected messages that can't be deferred to be aborted, got %v aborts", aborted)
+	}
+}
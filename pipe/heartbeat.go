@@ -0,0 +1,42 @@
+package pipe
+
+import (
+	"time"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// startHeartbeat extends the message lease every interval until the returned stop function is called, stop waits
+// for an extension in progress so the lease isn't extended after the message is settled.
+func (w *Worker) startHeartbeat(ctx *v1.RequestContext) (stop func()) {
+	extender, ok := ctx.Message().(v1.LeaseExtender)
+	if !ok || w.heartbeatInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(w.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := extender.ExtendLease(); err != nil {
+				w.logger.Warn().Err(err).Str("source", ctx.Source()).Msg("Failed to extend message lease")
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
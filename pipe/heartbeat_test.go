@@ -0,0 +1,55 @@
+package pipe
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testLeaseMessage counts its lease extensions, extensions fail while err is set.
+type testLeaseMessage struct {
+	*testMessage
+	extensions int
+	err        error
+}
+
+func (m *testLeaseMessage) ExtendLease() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.extensions++
+	return m.err
+}
+
+func (m *testLeaseMessage) extended() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.extensions
+}
+
+func TestHeartbeatExtendsLeaseUntilStopped(t *testing.T) {
+	w := newTestWorker(WithHeartbeat(10 * time.Millisecond))
+	m := &testLeaseMessage{testMessage: newTestMessage("1", "{}"), err: errors.New("lock lost")}
+	stop := w.startHeartbeat(newTestRequest(m))
+	time.Sleep(55 * time.Millisecond)
+	if extensions := m.extended(); extensions < 3 {
+		t.Fatalf("expected the lease to be extended every interval even after failures, got %v extensions", extensions)
+	}
+	stop()
+	extensions := m.extended()
+	time.Sleep(30 * time.Millisecond)
+	if m.extended() != extensions {
+		t.Fatal("expected the lease not to be extended once the message was handled")
+	}
+}
+
+func TestHeartbeatDisabled(t *testing.T) {
+	m := &testLeaseMessage{testMessage: newTestMessage("1", "{}")}
+	newTestWorker().startHeartbeat(newTestRequest(m))()
+	w := newTestWorker(WithHeartbeat(10 * time.Millisecond))
+	stop := w.startHeartbeat(newTestRequest(newTestMessage("2", "{}")))
+	time.Sleep(30 * time.Millisecond)
+	stop()
+	if m.extended() != 0 {
+		t.Fatal("expected no extensions without a heartbeat interval")
+	}
+}
@@ -0,0 +1,213 @@
+package pipe
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Window aggregates the handler calls of one rate window.
+type Window struct {
+	Count        int64
+	Backpressure int64
+	Latency      time.Duration
+	MaxInflight  int
+}
+
+func (w Window) AverageLatency() time.Duration {
+	if w.Count == 0 {
+		return 0
+	}
+	return w.Latency / time.Duration(w.Count)
+}
+
+// Limiter decides the pipe concurrency, Update is called at the end of every rate window.
+type Limiter interface {
+	Limit() int
+	Update(w Window) int
+}
+
+type window struct {
+	lock    sync.Mutex
+	current Window
+}
+
+func (w *window) observe(latency time.Duration, inflight int, backpressure bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.current.Count++
+	w.current.Latency += latency
+	if backpressure {
+		w.current.Backpressure++
+	}
+	if inflight > w.current.MaxInflight {
+		w.current.MaxInflight = inflight
+	}
+}
+
+func (w *window) reset() Window {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	c := w.current
+	w.current = Window{}
+	return c
+}
+
+func clamp(limit, min, max int) int {
+	if limit < min {
+		return min
+	}
+	if max > 0 && limit > max {
+		return max
+	}
+	return limit
+}
+
+type fixedLimiter struct {
+	limit int
+}
+
+func NewFixedLimiter(limit int) Limiter {
+	return &fixedLimiter{limit}
+}
+
+func (l *fixedLimiter) Limit() int {
+	return l.limit
+}
+
+func (l *fixedLimiter) Update(Window) int {
+	return l.limit
+}
+
+// hillClimbLimiter moves the concurrency by one in the direction that increased the throughput, and halves it
+// on backpressure.
+type hillClimbLimiter struct {
+	limit, min, max int
+	prev            int64
+	shouldUpscale   bool
+}
+
+func NewHillClimbLimiter(init, min, max int) Limiter {
+	return &hillClimbLimiter{
+		limit:         init,
+		min:           min,
+		max:           max,
+		shouldUpscale: true,
+	}
+}
+
+func (l *hillClimbLimiter) Limit() int {
+	return l.limit
+}
+
+func (l *hillClimbLimiter) Update(w Window) int {
+	if w.Count == 0 {
+		return l.limit
+	}
+	if w.Backpressure > 0 {
+		// The throughput of an overloaded handler isn't compared, climbing starts again from the lower limit
+		l.limit = clamp(l.limit/2, l.min, l.max)
+		l.prev = 0
+		l.shouldUpscale = true
+		return l.limit
+	}
+	if w.Count < l.prev {
+		l.shouldUpscale = !l.shouldUpscale
+	}
+	if l.shouldUpscale {
+		l.limit++
+	} else {
+		l.limit--
+	}
+	l.limit = clamp(l.limit, l.min, l.max)
+	l.prev = w.Count
+	return l.limit
+}
+
+// aimdLimiter increases the concurrency by one while it is used and backs off on backpressure.
+type aimdLimiter struct {
+	limit, min, max int
+	backoffRatio    float64
+}
+
+func NewAIMDLimiter(init, min, max int, backoffRatio float64) Limiter {
+	return &aimdLimiter{
+		limit:        init,
+		min:          min,
+		max:          max,
+		backoffRatio: backoffRatio,
+	}
+}
+
+func (l *aimdLimiter) Limit() int {
+	return l.limit
+}
+
+func (l *aimdLimiter) Update(w Window) int {
+	if w.Backpressure > 0 {
+		l.limit = int(float64(l.limit) * l.backoffRatio)
+	} else if w.MaxInflight >= l.limit {
+		l.limit++
+	}
+	l.limit = clamp(l.limit, l.min, l.max)
+	return l.limit
+}
+
+// gradientLimiter compares the window latency to the lowest latency seen, growing while they are close
+// and shrinking as requests start to queue in the handler.
+type gradientLimiter struct {
+	limit      float64
+	min, max   int
+	smoothing  float64
+	tolerance  float64
+	minLatency time.Duration
+	windows    int
+}
+
+// gradientLatencyProbe is the number of windows after which the lowest latency is measured again.
+const gradientLatencyProbe = 100
+
+func NewGradientLimiter(init, min, max int, smoothing, tolerance float64) Limiter {
+	return &gradientLimiter{
+		limit:     float64(init),
+		min:       min,
+		max:       max,
+		smoothing: smoothing,
+		tolerance: tolerance,
+	}
+}
+
+func (l *gradientLimiter) Limit() int {
+	return int(math.Round(l.limit))
+}
+
+func (l *gradientLimiter) Update(w Window) int {
+	if w.Count == 0 {
+		return l.Limit()
+	}
+	latency := w.AverageLatency()
+	l.windows++
+	// Handlers faster than the clock resolution report no latency, the gradient isn't measured until they don't
+	if latency > 0 && (l.minLatency == 0 || latency < l.minLatency || l.windows%gradientLatencyProbe == 0) {
+		l.minLatency = latency
+	}
+
+	var newLimit float64
+	if w.Backpressure > 0 {
+		newLimit = l.limit / 2
+	} else {
+		gradient := 1.0
+		if latency > 0 {
+			gradient = math.Max(0.5, math.Min(1, l.tolerance*float64(l.minLatency)/float64(latency)))
+		}
+		newLimit = l.limit * gradient
+		if w.MaxInflight >= l.Limit() {
+			newLimit += math.Sqrt(l.limit)
+		}
+	}
+	l.limit = math.Max(float64(l.min), (1-l.smoothing)*l.limit+l.smoothing*newLimit)
+	if l.max > 0 {
+		l.limit = math.Min(float64(l.max), l.limit)
+	}
+	return l.Limit()
+}
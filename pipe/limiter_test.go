@@ -0,0 +1,78 @@
+package pipe
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHillClimbLimiterBacksOffOnBackpressure(t *testing.T) {
+	l := NewHillClimbLimiter(10, 1, 100)
+	if limit := l.Update(Window{Count: 100}); limit != 11 {
+		t.Fatalf("expected the limit to climb, got %v", limit)
+	}
+	if limit := l.Update(Window{Count: 120, Backpressure: 3}); limit != 5 {
+		t.Fatalf("expected the limit to be halved on backpressure, got %v", limit)
+	}
+	if limit := l.Update(Window{Count: 50}); limit != 6 {
+		t.Fatalf("expected the limit to climb from the lower limit, got %v", limit)
+	}
+	for i := 0; i < 10; i++ {
+		l.Update(Window{Count: 10, Backpressure: 1})
+	}
+	if limit := l.Limit(); limit != 1 {
+		t.Fatalf("expected the limit to stop at the minimum, got %v", limit)
+	}
+}
+
+func TestAIMDLimiter(t *testing.T) {
+	l := NewAIMDLimiter(10, 2, 12, 0.5)
+	if limit := l.Update(Window{Count: 100, MaxInflight: 5}); limit != 10 {
+		t.Fatalf("expected the limit to stay while it isn't used, got %v", limit)
+	}
+	if limit := l.Update(Window{Count: 100, MaxInflight: 10}); limit != 11 {
+		t.Fatalf("expected the limit to grow while it is used, got %v", limit)
+	}
+	l.Update(Window{Count: 100, MaxInflight: 11})
+	if limit := l.Update(Window{Count: 100, MaxInflight: 12}); limit != 12 {
+		t.Fatalf("expected the limit to stop at the maximum, got %v", limit)
+	}
+	if limit := l.Update(Window{Count: 100, MaxInflight: 12, Backpressure: 1}); limit != 6 {
+		t.Fatalf("expected the limit to back off by the ratio, got %v", limit)
+	}
+	for i := 0; i < 5; i++ {
+		l.Update(Window{Count: 10, Backpressure: 1})
+	}
+	if limit := l.Limit(); limit != 2 {
+		t.Fatalf("expected the limit to stop at the minimum, got %v", limit)
+	}
+}
+
+func TestGradientLimiter(t *testing.T) {
+	l := NewGradientLimiter(10, 1, 100, 1, 1.5)
+	if limit := l.Update(Window{Count: 10, Latency: 100 * time.Millisecond, MaxInflight: 10}); limit != 13 {
+		t.Fatalf("expected the limit to grow while the latency is low, got %v", limit)
+	}
+	if limit := l.Update(Window{Count: 10, Latency: 400 * time.Millisecond, MaxInflight: 5}); limit != 7 {
+		t.Fatalf("expected the limit to shrink as the latency increases, got %v", limit)
+	}
+	if limit := l.Update(Window{Count: 10, Latency: 100 * time.Millisecond, Backpressure: 1}); limit != 3 {
+		t.Fatalf("expected the limit to be halved on backpressure, got %v", limit)
+	}
+	if limit := l.Update(Window{}); limit != 3 {
+		t.Fatalf("expected empty windows to keep the limit, got %v", limit)
+	}
+}
+
+func TestGradientLimiterWithoutLatency(t *testing.T) {
+	l := NewGradientLimiter(10, 1, 100, 0.2, 1.5)
+	for i := 0; i < 3; i++ {
+		limit := l.Update(Window{Count: 10, MaxInflight: 10})
+		if limit < 10 || limit > 100 {
+			t.Fatalf("expected windows without latency to keep a valid limit, got %v", limit)
+		}
+	}
+	l.Update(Window{Count: 10, Latency: 100 * time.Millisecond})
+	if limit := l.Update(Window{Count: 10, MaxInflight: 1}); limit < 1 || limit > 100 {
+		t.Fatalf("expected a valid limit, got %v", limit)
+	}
+}
@@ -0,0 +1,84 @@
+package pipe
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// testMessage records how it was settled.
+type testMessage struct {
+	lock      sync.Mutex
+	id        string
+	data      []byte
+	metadata  v1.Metadata
+	completed int
+	aborted   int
+	// redeliver is returned by Abort
+	redeliver bool
+}
+
+func newTestMessage(id string, data string) *testMessage {
+	return &testMessage{id: id, data: []byte(data), metadata: v1.Metadata{}, redeliver: true}
+}
+
+func (m *testMessage) Id() string {
+	return m.id
+}
+
+func (m *testMessage) Data() []byte {
+	return m.data
+}
+
+func (m *testMessage) Metadata() v1.Metadata {
+	return m.metadata
+}
+
+func (m *testMessage) Complete() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.completed++
+	return nil
+}
+
+func (m *testMessage) Abort(error) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.aborted++
+	return m.redeliver
+}
+
+func (m *testMessage) settled() (completed, aborted int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.completed, m.aborted
+}
+
+func newTestWorker(opts ...WorkerOption) *Worker {
+	logger := zerolog.Nop()
+	w := &Worker{Name: "test", logger: &logger}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+func newTestRequest(m v1.Message) *v1.RequestContext {
+	return v1.CreateRequestContext(context.Background(), "source", m)
+}
+
+// testDeferMessage records the delays it was deferred by.
+type testDeferMessage struct {
+	*testMessage
+	delays []time.Duration
+}
+
+func (m *testDeferMessage) Defer(delay time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.delays = append(m.delays, delay)
+	return nil
+}
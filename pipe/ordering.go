@@ -0,0 +1,73 @@
+package pipe
+
+import (
+	"context"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func (w *Worker) orderingKey(r *v1.RequestContext) (string, bool) {
+	m := r.Request()
+	return w.ordering.Evaluate(m.Id(), m.Data(), m.Metadata())
+}
+
+// order passes messages that share an ordering key one at a time, the next message of a key is passed once
+// the previous one was completed or aborted. Messages without a key are passed right away.
+// No more messages are read while the ordering buffer is full, so a busy key slows down the whole pipe.
+func (w *Worker) order(ctx context.Context, in chan *v1.RequestContext, out chan *v1.RequestContext) {
+	groups := map[string][]*v1.RequestContext{}
+	var ready []*v1.RequestContext
+	// waiting counts the messages behind the in flight message of their key
+	waiting := 0
+	for {
+		var send chan *v1.RequestContext
+		var next *v1.RequestContext
+		if len(ready) > 0 {
+			send, next = out, ready[0]
+		}
+		receive := in
+		if waiting+len(ready) >= w.orderingBuffer {
+			receive = nil
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case send <- next:
+			ready = ready[1:]
+		case r := <-receive:
+			key, ok := w.orderingKey(r)
+			if !ok {
+				ready = append(ready, r)
+				continue
+			}
+			groups[key] = append(groups[key], r)
+			if len(groups[key]) == 1 {
+				ready = append(ready, r)
+			} else {
+				waiting++
+			}
+		case key := <-w.orderingDone:
+			group := groups[key][1:]
+			if len(group) == 0 {
+				delete(groups, key)
+				continue
+			}
+			groups[key] = group
+			waiting--
+			ready = append(ready, group[0])
+		}
+	}
+}
+
+// releaseOrdering lets the next message with the same ordering key be handled.
+func (w *Worker) releaseOrdering(r *v1.RequestContext) {
+	if w.ordering == nil {
+		return
+	}
+	if key, ok := w.orderingKey(r); ok {
+		select {
+		case <-r.Done():
+		case w.orderingDone <- key:
+		}
+	}
+}
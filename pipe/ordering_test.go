@@ -0,0 +1,98 @@
+package pipe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func newOrderingWorker(t *testing.T, buffer int) (*Worker, chan *v1.RequestContext, chan *v1.RequestContext) {
+	key, err := utils.ParseKeyExpression("body.group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWorker(WithOrdering(key, buffer))
+	w.orderingDone = make(chan string)
+	in, out := make(chan *v1.RequestContext), make(chan *v1.RequestContext)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.order(ctx, in, out)
+	return w, in, out
+}
+
+func receive(t *testing.T, out chan *v1.RequestContext) string {
+	t.Helper()
+	select {
+	case r := <-out:
+		return r.Message().Id()
+	case <-time.After(time.Second):
+		t.Fatal("expected a message to be passed")
+		return ""
+	}
+}
+
+func sent(in chan *v1.RequestContext, r *v1.RequestContext) bool {
+	select {
+	case in <- r:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func TestOrderingPassesKeysOneAtATime(t *testing.T) {
+	w, in, out := newOrderingWorker(t, 10)
+	first := newTestRequest(newTestMessage("1", `{"group":"a"}`))
+	in <- first
+	in <- newTestRequest(newTestMessage("2", `{"group":"a"}`))
+	in <- newTestRequest(newTestMessage("3", `{"group":"b"}`))
+	in <- newTestRequest(newTestMessage("4", `{}`))
+	if id := receive(t, out); id != "1" {
+		t.Fatalf("expected 1, got %v", id)
+	}
+	if id := receive(t, out); id != "3" {
+		t.Fatalf("expected the other key to pass, got %v", id)
+	}
+	if id := receive(t, out); id != "4" {
+		t.Fatalf("expected the message without a key to pass, got %v", id)
+	}
+	select {
+	case r := <-out:
+		t.Fatalf("expected 2 to wait for 1, got %v", r.Message().Id())
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.releaseOrdering(first)
+	if id := receive(t, out); id != "2" {
+		t.Fatalf("expected 2 once 1 was released, got %v", id)
+	}
+}
+
+func TestOrderingStopsReadingWhenBufferIsFull(t *testing.T) {
+	w, in, out := newOrderingWorker(t, 2)
+	first := newTestRequest(newTestMessage("1", `{"group":"a"}`))
+	in <- first
+	in <- newTestRequest(newTestMessage("2", `{"group":"a"}`))
+	third := newTestRequest(newTestMessage("3", `{"group":"b"}`))
+	if sent(in, third) {
+		t.Fatal("expected no more messages to be read while the buffer is full")
+	}
+	if id := receive(t, out); id != "1" {
+		t.Fatalf("expected 1, got %v", id)
+	}
+	if !sent(in, third) {
+		t.Fatal("expected messages to be read once the buffer has room")
+	}
+	if sent(in, newTestRequest(newTestMessage("4", `{"group":"a"}`))) {
+		t.Fatal("expected no more messages to be read while the buffer is full")
+	}
+	if id := receive(t, out); id != "3" {
+		t.Fatalf("expected 3, got %v", id)
+	}
+	w.releaseOrdering(first)
+	if id := receive(t, out); id != "2" {
+		t.Fatalf("expected 2, got %v", id)
+	}
+}
@@ -0,0 +1,90 @@
+package pipe
+
+import (
+	"context"
+	"sync"
+)
+
+// pool bounds the number of concurrently handled requests, it can be resized while in use.
+type pool struct {
+	lock    sync.Mutex
+	size    int
+	active  int
+	waiters []chan struct{}
+}
+
+func newPool(size int) *pool {
+	return &pool{
+		size: size,
+	}
+}
+
+// Acquire blocks until a slot is available or ctx is done.
+func (p *pool) Acquire(ctx context.Context) error {
+	p.lock.Lock()
+	if p.active < p.size && len(p.waiters) == 0 {
+		p.active++
+		p.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	p.waiters = append(p.waiters, ready)
+	p.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-ready:
+		// The slot was granted while giving up, pass it on
+		p.active--
+		p.notify()
+	default:
+		for i, w := range p.waiters {
+			if w == ready {
+				p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+func (p *pool) Release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.active--
+	p.notify()
+}
+
+func (p *pool) Resize(size int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.size = size
+	p.notify()
+}
+
+func (p *pool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.size
+}
+
+func (p *pool) Active() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.active
+}
+
+func (p *pool) notify() {
+	for p.active < p.size && len(p.waiters) > 0 {
+		close(p.waiters[0])
+		p.waiters = p.waiters[1:]
+		p.active++
+	}
+}
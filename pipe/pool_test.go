@@ -0,0 +1,88 @@
+package pipe
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func acquired(p *pool, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.Acquire(ctx) == nil
+}
+
+func TestPoolShrinkWhileHeld(t *testing.T) {
+	p := newPool(3)
+	for i := 0; i < 3; i++ {
+		if !acquired(p, time.Second) {
+			t.Fatal("expected a free slot")
+		}
+	}
+	p.Resize(1)
+	if p.Active() != 3 {
+		t.Fatalf("expected held slots to be kept when shrinking, got %v", p.Active())
+	}
+	p.Release()
+	if acquired(p, 20*time.Millisecond) {
+		t.Fatal("expected no slot while more slots are held than the pool size")
+	}
+	p.Release()
+	if acquired(p, 20*time.Millisecond) {
+		t.Fatal("expected no slot while the pool is full")
+	}
+	p.Release()
+	if !acquired(p, time.Second) {
+		t.Fatal("expected a slot once the held slots drained below the size")
+	}
+	if p.Active() != 1 {
+		t.Fatalf("expected 1 active slot, got %v", p.Active())
+	}
+}
+
+func TestPoolGrowWakesWaiters(t *testing.T) {
+	p := newPool(1)
+	p.Acquire(context.Background())
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- p.Acquire(context.Background()) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	p.Resize(3)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected growing the pool to grant slots to waiters")
+		}
+	}
+	if p.Active() != 3 {
+		t.Fatalf("expected 3 active slots, got %v", p.Active())
+	}
+}
+
+func TestPoolCanceledWaiterPassesSlotOn(t *testing.T) {
+	p := newPool(1)
+	p.Acquire(context.Background())
+	if acquired(p, 20*time.Millisecond) {
+		t.Fatal("expected the pool to be full")
+	}
+	next := make(chan error, 1)
+	go func() { next <- p.Acquire(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	p.Release()
+	select {
+	case err := <-next:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the released slot to go to the remaining waiter")
+	}
+	if p.Active() != 1 || len(p.waiters) != 0 {
+		t.Fatalf("expected a single active slot and no waiters, got %v and %v", p.Active(), len(p.waiters))
+	}
+}
@@ -0,0 +1,167 @@
+package pipe
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/soluto/dqd/handlers"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type RetryMode string
+
+const (
+	// RetryInProcess retries the handler call without releasing the message.
+	RetryInProcess = RetryMode("inProcess")
+	// RetryRedeliver releases the message back to the provider with a visibility delay.
+	RetryRedeliver = RetryMode("redeliver")
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	Mode        RetryMode
+	Backoff     backoff.Backoff
+	RetryOn     []handlers.HandlerErrorCode
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if _, throttled := handlers.IsThrottled(err); throttled {
+		return false
+	}
+	handlerErr, ok := err.(handlers.HandlerError)
+	if !ok {
+		return true
+	}
+	for _, code := range p.RetryOn {
+		if handlerErr.Code() == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	return p.Backoff.ForAttempt(float64(attempt - 1))
+}
+
+// maxRedeliveries bounds the tracked messages, messages redelivered to other replicas are never forgotten.
+const maxRedeliveries = 10000
+
+type redelivery struct {
+	id       string
+	failures int
+}
+
+// redeliveries counts the failed deliveries of messages whose source doesn't count them, by message id.
+// Up to size messages are tracked, the least recently failed messages are evicted first and start counting again.
+type redeliveries struct {
+	lock     sync.Mutex
+	size     int
+	failures map[string]*list.Element
+	order    *list.List
+}
+
+func newRedeliveries(size int) *redeliveries {
+	return &redeliveries{
+		size:     size,
+		failures: map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// failed records a failed delivery and returns the number of failed deliveries.
+func (r *redeliveries) failed(m v1.Message) int {
+	if c, ok := m.(v1.DeliveryCounter); ok && c.DeliveryCount() > 0 {
+		return int(c.DeliveryCount())
+	}
+	if m.Id() == "" {
+		// The message can't be tracked, giving up is safer than redelivering it forever
+		return -1
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if e, ok := r.failures[m.Id()]; ok {
+		e.Value.(*redelivery).failures++
+		r.order.MoveToFront(e)
+		return e.Value.(*redelivery).failures
+	}
+	r.failures[m.Id()] = r.order.PushFront(&redelivery{m.Id(), 1})
+	for r.order.Len() > r.size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.failures, oldest.Value.(*redelivery).id)
+	}
+	return 1
+}
+
+// forget removes the message once it won't be redelivered, pipes without a retry policy don't track messages.
+func (r *redeliveries) forget(m v1.Message) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if e, ok := r.failures[m.Id()]; ok {
+		r.order.Remove(e)
+		delete(r.failures, m.Id())
+	}
+}
+
+func (w *Worker) handleRequestWithRetries(ctx *v1.RequestContext) (*v1.RawMessage, int, error) {
+	result, err := w.handleRequest(ctx)
+	attempt := 1
+	p := w.retryPolicy
+	if p == nil || p.Mode != RetryInProcess {
+		return result, attempt, err
+	}
+	for ; err != nil && attempt < p.MaxAttempts && p.retryable(err); attempt++ {
+		delay := p.delay(attempt)
+		w.logger.Debug().Err(err).Int("attempt", attempt).Dur("delay", delay).Msg("Retrying message")
+		select {
+		case <-ctx.Done():
+			return result, attempt, err
+		case <-time.After(delay):
+		}
+		result, err = w.handleRequest(ctx)
+	}
+	return result, attempt, err
+}
+
+func (w *Worker) retryOrGiveUp(ctx *v1.RequestContext, err error, errProducer v1.Producer) {
+	m := ctx.Message()
+	p := w.retryPolicy
+	if p.Mode == RetryRedeliver && p.retryable(err) {
+		if attempt := w.redeliveries.failed(m); attempt > 0 && attempt < p.MaxAttempts {
+			if d, ok := m.(v1.Deferrer); ok {
+				if deferErr := d.Defer(p.delay(attempt)); deferErr != nil {
+					w.logger.Error().Err(deferErr).Msg("Failed to defer message")
+				}
+				return
+			}
+			m.Abort(err)
+			return
+		}
+	}
+	if !w.writeToErrorSource || errProducer == nil {
+		w.giveUp(ctx, err)
+		return
+	}
+	w.deadLetter(ctx, err, errProducer)
+}
+
+// giveUp moves the message to the provider dead letter queue when supported, otherwise it is aborted.
+func (w *Worker) giveUp(ctx *v1.RequestContext, err error) {
+	m := ctx.Message()
+	w.redeliveries.forget(m)
+	if d, ok := m.(v1.DeadLetterer); ok {
+		w.logger.Warn().Err(err).Msg("Dead lettering message to source dead letter queue")
+		dlErr := d.DeadLetter(err)
+		if dlErr == nil {
+			return
+		}
+		w.logger.Error().Err(dlErr).Msg("Failed to dead letter message")
+	}
+	m.Abort(err)
+}
@@ -0,0 +1,58 @@
+package pipe
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jpillora/backoff"
+)
+
+func TestRedeliverTracksMessagesWithoutDeliveryCount(t *testing.T) {
+	w := newTestWorker(WithRetryPolicy(&RetryPolicy{MaxAttempts: 3, Mode: RetryRedeliver, Backoff: backoff.Backoff{}}))
+	err := errors.New("failed")
+	m := newTestMessage("1", "{}")
+	for i := 1; i < 3; i++ {
+		w.retryOrGiveUp(newTestRequest(m), err, nil)
+		if failures := w.redeliveries.failures["1"].Value.(*redelivery).failures; failures != i {
+			t.Fatalf("expected %v failed deliveries, got %v", i, failures)
+		}
+	}
+	// Given up by aborting since there is no error source
+	w.retryOrGiveUp(newTestRequest(m), err, nil)
+	if _, aborted := m.settled(); aborted != 3 {
+		t.Fatalf("expected 3 aborts, got %v", aborted)
+	}
+	if len(w.redeliveries.failures) != 0 {
+		t.Fatalf("expected the message to be forgotten once given up, got %v", w.redeliveries.failures)
+	}
+
+	untracked := newTestMessage("", "{}")
+	w.retryOrGiveUp(newTestRequest(untracked), err, nil)
+	if len(w.redeliveries.failures) != 0 {
+		t.Fatal("expected messages without an id not to be tracked")
+	}
+}
+
+func TestRedeliveriesEvictsLeastRecentlyFailed(t *testing.T) {
+	r := newRedeliveries(2)
+	first, second, third := newTestMessage("1", "{}"), newTestMessage("2", "{}"), newTestMessage("3", "{}")
+	r.failed(first)
+	r.failed(second)
+	if failures := r.failed(first); failures != 2 {
+		t.Fatalf("expected 2 failed deliveries, got %v", failures)
+	}
+	r.failed(third)
+	if len(r.failures) != 2 || r.order.Len() != 2 {
+		t.Fatalf("expected 2 tracked messages, got %v", len(r.failures))
+	}
+	if _, ok := r.failures["2"]; ok {
+		t.Fatal("expected the least recently failed message to be evicted")
+	}
+	if failures := r.failed(first); failures != 3 {
+		t.Fatalf("expected the recently failed message to be kept, got %v failed deliveries", failures)
+	}
+	r.forget(first)
+	if _, ok := r.failures["1"]; ok || r.order.Len() != 1 {
+		t.Fatal("expected the message to be forgotten")
+	}
+}
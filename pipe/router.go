@@ -0,0 +1,128 @@
+package pipe
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/soluto/dqd/metrics"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type RouterMode string
+
+const (
+	// RouterFirst writes the response to the destinations of the first matching rule.
+	RouterFirst = RouterMode("first")
+	// RouterBroadcast writes the response to the destinations of every matching rule.
+	RouterBroadcast = RouterMode("broadcast")
+)
+
+type DestinationFailure string
+
+const (
+	// DestinationIgnore logs responses that failed to be written to the destination.
+	DestinationIgnore = DestinationFailure("ignore")
+	// DestinationFail handles the message as failed when the response failed to be written to the destination.
+	DestinationFail = DestinationFailure("fail")
+)
+
+type Destination struct {
+	Source    *v1.Source
+	OnFailure DestinationFailure
+}
+
+// RouterRule matches handler responses, a rule without conditions matches every response.
+type RouterRule struct {
+	Conditions   []*Condition
+	Any          bool
+	Destinations []*Destination
+}
+
+// Router picks the outputs of handler responses.
+type Router struct {
+	Mode  RouterMode
+	Rules []*RouterRule
+}
+
+// destinations returns the destinations of the matching rules, every destination is returned once.
+func (r *Router) destinations(id string, m *v1.RawMessage) []*Destination {
+	var result []*Destination
+	seen := map[string]bool{}
+	for _, rule := range r.Rules {
+		if !matchConditions(rule.Conditions, rule.Any, id, m.Data, m.Metadata) {
+			continue
+		}
+		for _, d := range rule.Destinations {
+			if !seen[d.Source.Name] {
+				seen[d.Source.Name] = true
+				result = append(result, d)
+			}
+		}
+		if r.Mode != RouterBroadcast {
+			break
+		}
+	}
+	return result
+}
+
+// createRouterProducers creates a producer for every router destination, keyed by source name.
+func (w *Worker) createRouterProducers(ctx context.Context) map[string]v1.Producer {
+	producers := map[string]v1.Producer{}
+	if w.router == nil {
+		return producers
+	}
+	for _, rule := range w.router.Rules {
+		for _, d := range rule.Destinations {
+			if _, ok := producers[d.Source.Name]; !ok {
+				producers[d.Source.Name] = w.coalesceProducer(ctx, d.Source.CreateProducer())
+				w.probe.Register(producers[d.Source.Name], "outputs."+d.Source.Name)
+			}
+		}
+	}
+	return producers
+}
+
+// unroutedDestination is the destination label of responses that matched no rule.
+const unroutedDestination = "none"
+
+// routeResponse writes the response to its destinations concurrently, it fails only when a destination that
+// fails the message couldn't be written. A failed message is written again to all of its destinations once it is
+// handled again, including the ones that succeeded.
+func (w *Worker) routeResponse(ctx *v1.RequestContext, m *v1.RawMessage, producers map[string]v1.Producer) error {
+	destinations := w.router.destinations(ctx.Message().Id(), m)
+	if len(destinations) == 0 {
+		w.logger.Debug().Str("id", ctx.Message().Id()).Msg("Handler response matched no router rule")
+		metrics.WorkerRoutedCounter.WithLabelValues(w.Name, unroutedDestination, "true").Inc()
+		return nil
+	}
+	errs := make([]error, len(destinations))
+	var wg sync.WaitGroup
+	for i, d := range destinations {
+		wg.Add(1)
+		go func(i int, d *Destination) {
+			defer wg.Done()
+			errs[i] = producers[d.Source.Name].Produce(ctx, m)
+			metrics.WorkerRoutedCounter.WithLabelValues(w.Name, d.Source.Name, strconv.FormatBool(errs[i] == nil)).Inc()
+		}(i, d)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, d := range destinations {
+		if errs[i] == nil {
+			continue
+		}
+		if d.OnFailure == DestinationFail {
+			failed = append(failed, fmt.Sprintf("%v: %v", d.Source.Name, errs[i]))
+			continue
+		}
+		w.logger.Error().Err(errs[i]).Str("destination", d.Source.Name).Msg("Failed to write handler response to destination")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to write handler response to %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
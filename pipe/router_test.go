@@ -0,0 +1,43 @@
+package pipe
+
+import (
+	"testing"
+
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func TestRouterDestinations(t *testing.T) {
+	typeKey, err := utils.ParseKeyExpression("body.type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := &Destination{Source: &v1.Source{Name: "orders"}}
+	audit := &Destination{Source: &v1.Source{Name: "audit"}}
+	router := &Router{
+		Mode: RouterFirst,
+		Rules: []*RouterRule{
+			{Conditions: []*Condition{{Key: typeKey, In: []string{"order"}}}, Destinations: []*Destination{orders, audit}},
+			{Destinations: []*Destination{audit}},
+		},
+	}
+	order := &v1.RawMessage{Data: []byte(`{"type":"order"}`)}
+	other := &v1.RawMessage{Data: []byte(`{"type":"other"}`)}
+
+	if d := router.destinations("1", order); len(d) != 2 {
+		t.Fatalf("expected the first matching rule destinations, got %v", len(d))
+	}
+	if d := router.destinations("1", other); len(d) != 1 || d[0] != audit {
+		t.Fatalf("expected the default rule destination, got %v", d)
+	}
+
+	router.Mode = RouterBroadcast
+	if d := router.destinations("1", order); len(d) != 2 {
+		t.Fatalf("expected every destination once, got %v", len(d))
+	}
+
+	router.Rules = router.Rules[:1]
+	if d := router.destinations("1", other); len(d) != 0 {
+		t.Fatalf("expected no destinations, got %v", len(d))
+	}
+}
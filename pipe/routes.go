@@ -0,0 +1,74 @@
+package pipe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/soluto/dqd/handlers"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+type RouteAction string
+
+const (
+	// RouteComplete completes the message and writes the handler response to the output.
+	RouteComplete = RouteAction("complete")
+	// RouteRetry handles the message as failed.
+	RouteRetry = RouteAction("retry")
+	// RouteDeadLetter writes the message to the error source and completes it.
+	RouteDeadLetter = RouteAction("deadLetter")
+	// RouteDrop completes the message without writing the response.
+	RouteDrop = RouteAction("drop")
+)
+
+// Route maps handler response status codes to an action, statuses are codes ("409") or classes ("4xx").
+type Route struct {
+	Statuses []string
+	Action   RouteAction
+	// Source overrides the pipe output, or the error source for dead letters.
+	Source *v1.Source
+}
+
+func (r *Route) matches(status int) bool {
+	code := strconv.Itoa(status)
+	for _, s := range r.Statuses {
+		if s == code || (strings.HasSuffix(strings.ToLower(s), "xx") && len(s) == 3 && s[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Worker) matchRoute(status int) (int, *Route) {
+	for i, r := range w.routes {
+		if r.matches(status) {
+			return i, r
+		}
+	}
+	return -1, nil
+}
+
+// resultStatus returns the http like status of the handler result.
+func resultStatus(m *v1.RawMessage, err error) int {
+	if err != nil {
+		handlerErr, ok := err.(handlers.HandlerError)
+		if !ok {
+			return 500
+		}
+		if handlerErr.Status() > 0 {
+			return handlerErr.Status()
+		}
+		return int(handlerErr.Code()) * 100
+	}
+	if m != nil {
+		if status, convErr := strconv.Atoi(m.Metadata[v1.MetadataStatusCode]); convErr == nil {
+			return status
+		}
+	}
+	return 200
+}
+
+func routeError(status int) error {
+	return fmt.Errorf("handler response routed as failure: %d", status)
+}
@@ -0,0 +1,156 @@
+package pipe
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/soluto/dqd/handlers"
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// splitParent completes the parent message once all of its children were completed, or aborts it once all of
+// them were settled and any of them failed.
+type splitParent struct {
+	lock      sync.Mutex
+	remaining int
+	err       error
+	complete  func() error
+	abort     func(error) bool
+}
+
+// settle records a settled child, the parent is completed or aborted by the last one.
+func (p *splitParent) settle(err error) (last bool, failed error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.remaining--
+	if p.err == nil {
+		p.err = err
+	}
+	return p.remaining == 0, p.err
+}
+
+// splitMessage is an item of a split message, acknowledgements are applied to the parent.
+type splitMessage struct {
+	v1.Message
+	id       string
+	data     []byte
+	metadata v1.Metadata
+	parent   *splitParent
+	// settled is set once the item was completed or aborted, recovered is set when aborting the last item
+	// didn't return the parent to the source
+	settled   bool
+	recovered bool
+}
+
+func (m *splitMessage) Id() string {
+	return m.id
+}
+
+func (m *splitMessage) Data() []byte {
+	return m.data
+}
+
+func (m *splitMessage) Metadata() v1.Metadata {
+	return m.metadata
+}
+
+func (m *splitMessage) Complete() error {
+	if m.recovered {
+		// The item was written to the error source, the parent won't be redelivered
+		return m.parent.complete()
+	}
+	if m.settled {
+		return nil
+	}
+	m.settled = true
+	last, err := m.parent.settle(nil)
+	if !last {
+		return nil
+	}
+	if err != nil {
+		m.parent.abort(err)
+		return nil
+	}
+	return m.parent.complete()
+}
+
+// Abort returns true unless this is the last item and the parent won't be redelivered.
+func (m *splitMessage) Abort(err error) bool {
+	if m.settled {
+		return true
+	}
+	m.settled = true
+	if err == nil {
+		err = fmt.Errorf("split message %v aborted", m.id)
+	}
+	last, err := m.parent.settle(err)
+	if !last {
+		return true
+	}
+	m.recovered = !m.parent.abort(err)
+	return !m.recovered
+}
+
+func (m *splitMessage) ExtendLease() error {
+	if extender, ok := m.Message.(v1.LeaseExtender); ok {
+		return extender.ExtendLease()
+	}
+	return nil
+}
+
+func (m *splitMessage) DeliveryCount() int64 {
+	if counter, ok := m.Message.(v1.DeliveryCounter); ok {
+		return counter.DeliveryCount()
+	}
+	return 0
+}
+
+// completeEmpty completes a message split into no items.
+func (w *Worker) completeEmpty(r *v1.RequestContext) {
+	defer w.inflight.Done()
+	if err := w.complete(r); err != nil {
+		w.logger.Error().Err(err).Msg("Failed to complete empty split message")
+		r.Abort(err)
+	}
+}
+
+// failRequest handles a request that can't be dispatched as failed.
+func (w *Worker) failRequest(r *v1.RequestContext, err error, errProducer v1.Producer) {
+	defer w.inflight.Done()
+	w.handleErrorRequest(r, err, errProducer)
+}
+
+// splitRequest turns a request into a request for every item of the json array at the split path, it fails
+// when the path isn't an array. Items get a deduplication id derived from the message one.
+func (w *Worker) splitRequest(ctx context.Context, r *v1.RequestContext) ([]*v1.RequestContext, error) {
+	m := r.Request()
+	value, ok := utils.JsonPath(m.Data(), w.splitPath)
+	items, isArray := value.([]interface{})
+	if !ok || !isArray {
+		return nil, handlers.BadRequestError(fmt.Errorf("missing json array to split at %q", w.splitPath))
+	}
+
+	parent := &splitParent{
+		remaining: len(items),
+		complete:  func() error { return w.complete(r) },
+		abort:     r.Abort,
+	}
+	children := make([]*v1.RequestContext, len(items))
+	for i, item := range items {
+		metadata := m.Metadata().Copy()
+		if deduplicationId, ok := metadata[v1.MetadataDeduplicationId]; ok {
+			metadata[v1.MetadataDeduplicationId] = fmt.Sprintf("%v-%v", deduplicationId, i)
+		}
+		child := &splitMessage{
+			Message:  r.Message(),
+			id:       fmt.Sprintf("%v-%v", m.Id(), i),
+			data:     []byte(utils.JsonString(item)),
+			metadata: metadata,
+			parent:   parent,
+		}
+		children[i] = v1.CreateRequestContext(ctx, r.Source(), child)
+	}
+	return children, nil
+}
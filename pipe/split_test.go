@@ -0,0 +1,109 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/soluto/dqd/handlers"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func TestSplitRequest(t *testing.T) {
+	w := newTestWorker(WithSplit("items"))
+	m := newTestMessage("1", `{"items":[{"a":1},"b",3]}`)
+	m.metadata[v1.MetadataDeduplicationId] = "d"
+	children, err := w.splitRequest(context.Background(), newTestRequest(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`{"a":1}`, "b", "3"}
+	if len(children) != len(expected) {
+		t.Fatalf("expected %v items, got %v", len(expected), len(children))
+	}
+	for i, child := range children {
+		request := child.Request()
+		if string(request.Data()) != expected[i] {
+			t.Errorf("item %v: expected %q, got %q", i, expected[i], request.Data())
+		}
+		if id := request.Id(); id != fmt.Sprintf("1-%v", i) {
+			t.Errorf("item %v: unexpected id %q", i, id)
+		}
+		if id := request.Metadata()[v1.MetadataDeduplicationId]; id != fmt.Sprintf("d-%v", i) {
+			t.Errorf("item %v: unexpected deduplication id %q", i, id)
+		}
+	}
+	if m.metadata[v1.MetadataDeduplicationId] != "d" {
+		t.Error("expected the message metadata not to change")
+	}
+}
+
+func TestSplitRequestWithoutArray(t *testing.T) {
+	w := newTestWorker(WithSplit("items"))
+	for _, data := range []string{`{"items":{"a":1}}`, `{}`, `not json`} {
+		_, err := w.splitRequest(context.Background(), newTestRequest(newTestMessage("1", data)))
+		handlerErr, ok := err.(handlers.HandlerError)
+		if !ok || handlerErr.Code() != 4 {
+			t.Errorf("%v: expected a bad request error, got %v", data, err)
+		}
+	}
+}
+
+func splitTestMessage(t *testing.T, items string) (*testMessage, []v1.Message) {
+	w := newTestWorker(WithSplit("items"))
+	m := newTestMessage("1", `{"items":`+items+`}`)
+	children, err := w.splitRequest(context.Background(), newTestRequest(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]v1.Message, len(children))
+	for i, child := range children {
+		messages[i] = child.Message()
+	}
+	return m, messages
+}
+
+func TestSplitMessageCompletesParentOnce(t *testing.T) {
+	m, children := splitTestMessage(t, "[1,2,3]")
+	for _, child := range children {
+		if completed, _ := m.settled(); completed != 0 {
+			t.Fatal("expected the parent to wait for all of the items")
+		}
+		child.Complete()
+		// Settling an item twice doesn't count twice
+		child.Complete()
+	}
+	if completed, aborted := m.settled(); completed != 1 || aborted != 0 {
+		t.Fatalf("expected the parent to be completed once, got %v completes %v aborts", completed, aborted)
+	}
+}
+
+func TestSplitMessageAbortsParentOnFailure(t *testing.T) {
+	m, children := splitTestMessage(t, "[1,2,3]")
+	children[0].Complete()
+	if !children[1].Abort(errors.New("failed")) {
+		t.Fatal("expected items before the last one to be redelivered with the parent")
+	}
+	if _, aborted := m.settled(); aborted != 0 {
+		t.Fatal("expected the parent to wait for all of the items")
+	}
+	children[2].Complete()
+	if completed, aborted := m.settled(); completed != 0 || aborted != 1 {
+		t.Fatalf("expected the parent to be aborted, got %v completes %v aborts", completed, aborted)
+	}
+}
+
+func TestSplitMessageCompletesRecoveredParent(t *testing.T) {
+	m, children := splitTestMessage(t, "[1,2]")
+	m.redeliver = false
+	children[0].Complete()
+	if children[1].Abort(errors.New("failed")) {
+		t.Fatal("expected the last item to report the parent won't be redelivered")
+	}
+	// The item was written to the error source, completing it completes the parent
+	children[1].Complete()
+	if completed, aborted := m.settled(); completed != 1 || aborted != 1 {
+		t.Fatalf("expected the parent to be aborted and completed, got %v completes %v aborts", completed, aborted)
+	}
+}
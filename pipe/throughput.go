@@ -0,0 +1,71 @@
+package pipe
+
+import (
+	"context"
+	"time"
+
+	"github.com/soluto/dqd/metrics"
+	v1 "github.com/soluto/dqd/v1"
+	"golang.org/x/time/rate"
+)
+
+func newThroughputLimiter(perSecond float64, burst int) *rate.Limiter {
+	if burst < 1 {
+		burst = int(perSecond)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// throttle waits for the throughput limiter, the time spent waiting is reported as throttled.
+func (w *Worker) throttle(ctx context.Context, limiter *rate.Limiter, source string) error {
+	if limiter == nil {
+		return nil
+	}
+	start := time.Now()
+	err := limiter.Wait(ctx)
+	metrics.WorkerThrottledTimeCounter.WithLabelValues(w.Name, source).Add(time.Since(start).Seconds())
+	return err
+}
+
+// pause holds dispatching for the delay, overlapping pauses end with the latest one.
+func (w *Worker) pause(delay time.Duration) {
+	w.pauseLock.Lock()
+	defer w.pauseLock.Unlock()
+	if until := time.Now().Add(delay); until.After(w.pausedUntil) {
+		w.pausedUntil = until
+	}
+}
+
+func (w *Worker) waitForPause(ctx context.Context, source string) error {
+	w.pauseLock.Lock()
+	delay := time.Until(w.pausedUntil)
+	w.pauseLock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	metrics.WorkerThrottledTimeCounter.WithLabelValues(w.Name, source).Add(delay.Seconds())
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// handleThrottledRequest pauses the pipe and returns the message to the source once the delay has passed.
+func (w *Worker) handleThrottledRequest(ctx *v1.RequestContext, err error, retryAfter time.Duration) {
+	w.logger.Debug().Err(err).Dur("retryAfter", retryAfter).Msg("Handler throttled, pausing pipe")
+	w.pause(retryAfter)
+	m := ctx.Message()
+	if d, ok := m.(v1.Deferrer); ok {
+		deferErr := d.Defer(retryAfter)
+		if deferErr == nil {
+			return
+		}
+		w.logger.Warn().Err(deferErr).Msg("Failed to defer throttled message")
+	}
+	m.Abort(err)
+}
@@ -0,0 +1,85 @@
+package pipe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThroughputLimiterBurst(t *testing.T) {
+	if burst := newThroughputLimiter(20, 0).Burst(); burst != 20 {
+		t.Fatalf("expected the burst to default to the rate, got %v", burst)
+	}
+	if burst := newThroughputLimiter(0.5, 0).Burst(); burst != 1 {
+		t.Fatalf("expected the burst to allow at least one message, got %v", burst)
+	}
+	if burst := newThroughputLimiter(20, 5).Burst(); burst != 5 {
+		t.Fatalf("expected the configured burst, got %v", burst)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	w := newTestWorker()
+	ctx := context.Background()
+	if err := w.throttle(ctx, nil, "source"); err != nil {
+		t.Fatalf("expected pipes without a limit not to wait, got %v", err)
+	}
+	limiter := newThroughputLimiter(20, 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := w.throttle(ctx, limiter, "source"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected 3 messages at 20 per second to take 100ms, took %v", elapsed)
+	}
+}
+
+func TestThrottleStopsOnShutdown(t *testing.T) {
+	w := newTestWorker()
+	limiter := newThroughputLimiter(0.1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	w.throttle(ctx, limiter, "source")
+	cancel()
+	if err := w.throttle(ctx, limiter, "source"); err == nil {
+		t.Fatal("expected waiting to stop on shutdown")
+	}
+}
+
+func TestPause(t *testing.T) {
+	w := newTestWorker()
+	w.pause(100 * time.Millisecond)
+	w.pause(10 * time.Millisecond)
+	start := time.Now()
+	if err := w.waitForPause(context.Background(), "source"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected overlapping pauses to end with the latest one, waited %v", elapsed)
+	}
+	start = time.Now()
+	w.waitForPause(context.Background(), "source")
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("expected no wait once the pause ended, waited %v", elapsed)
+	}
+}
+
+func TestHandleThrottledRequest(t *testing.T) {
+	w := newTestWorker()
+	err := errors.New("throttled")
+	deferred := &testDeferMessage{testMessage: newTestMessage("1", "{}")}
+	w.handleThrottledRequest(newTestRequest(deferred), err, time.Second)
+	if _, aborted := deferred.settled(); aborted != 0 || len(deferred.delays) != 1 || deferred.delays[0] != time.Second {
+		t.Fatalf("expected the message to be deferred by the delay, got %v aborts and %v", aborted, deferred.delays)
+	}
+	aborted := newTestMessage("2", "{}")
+	w.handleThrottledRequest(newTestRequest(aborted), err, time.Second)
+	if _, count := aborted.settled(); count != 1 {
+		t.Fatalf("expected messages that can't be deferred to be aborted, got %v aborts", count)
+	}
+	if time.Until(w.pausedUntil) <= 0 {
+		t.Fatal("expected the pipe to be paused")
+	}
+}
@@ -0,0 +1,32 @@
+package pipe
+
+import (
+	"fmt"
+
+	"github.com/soluto/dqd/handlers"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// transformRequest applies the request transforms, messages that can't be transformed fail as bad requests.
+func (w *Worker) transformRequest(m v1.Message) (v1.Message, error) {
+	if len(w.requestTransform) == 0 {
+		return m, nil
+	}
+	payload, err := w.requestTransform.Apply(&v1.RawMessage{Data: m.Data(), Metadata: m.Metadata()})
+	if err != nil {
+		return nil, handlers.BadRequestError(fmt.Errorf("failed to transform request: %w", err))
+	}
+	return &v1.PayloadMessage{Message: m, Payload: payload}, nil
+}
+
+// transformResponse applies the response transforms, responses that can't be transformed fail the message.
+func (w *Worker) transformResponse(m *v1.RawMessage) (*v1.RawMessage, error) {
+	if len(w.responseTransform) == 0 {
+		return m, nil
+	}
+	result, err := w.responseTransform.Apply(m)
+	if err != nil {
+		return nil, handlers.BadRequestError(fmt.Errorf("failed to transform response: %w", err))
+	}
+	return result, nil
+}
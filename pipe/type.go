@@ -1,46 +1,98 @@
 package pipe
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/soluto/dqd/handlers"
 	"github.com/soluto/dqd/health"
+	"github.com/soluto/dqd/transform"
+	"github.com/soluto/dqd/utils"
 	v1 "github.com/soluto/dqd/v1"
+	"golang.org/x/time/rate"
 )
 
 type WorkerOption func(w *Worker)
 
 type Worker struct {
-	Name                     string
-	sources                  []*v1.Source
-	output                   *v1.Source
-	errorSource              *v1.Source
-	handler                  handlers.Handler
-	logger                   *zerolog.Logger
-	maxDequeueCount          int64
-	fixedRate                bool
-	dynamicRateBatchWindow   time.Duration
-	concurrencyStartingPoint int
-	minConcurrency           int
-	writeToErrorSource       bool
-	probe                    *health.Probe
+	Name               string
+	sources            []*v1.Source
+	output             *v1.Source
+	errorSource        *v1.Source
+	handler            handlers.Handler
+	logger             *zerolog.Logger
+	maxDequeueCount    int64
+	limiter            Limiter
+	rateWindow         time.Duration
+	window             window
+	pool               *pool
+	throughput         *rate.Limiter
+	sourceThroughput   map[string]*rate.Limiter
+	pauseLock          sync.Mutex
+	pausedUntil        time.Time
+	writeToErrorSource bool
+	errorEnvelope      bool
+	unwrapEnvelope     bool
+	retryPolicy        *RetryPolicy
+	redeliveries       *redeliveries
+	batchSize          int
+	batchWindow        time.Duration
+	coalesceSize       int
+	coalesceWindow     time.Duration
+	completers         map[string]*coalescer
+	ordering           *utils.KeyExpression
+	orderingBuffer     int
+	orderingDone       chan string
+	routes             []*Route
+	filter             *Filter
+	router             *Router
+	split              bool
+	splitPath          string
+	aggregate          *Aggregate
+	dedup              *Deduplication
+	requestTransform   transform.Pipeline
+	responseTransform  transform.Pipeline
+	heartbeatInterval  time.Duration
+	drainTimeout       time.Duration
+	probe              *health.Probe
+	stopped            atomic.Value
+	consuming          sync.WaitGroup
+	inflight           sync.WaitGroup
 }
 
 func WithDynamicRate(start, min int, windowSize time.Duration) WorkerOption {
+	return WithLimiter(NewHillClimbLimiter(start, min, 0), windowSize)
+}
+
+func WithFixedRate(rate int) WorkerOption {
+	return WithLimiter(NewFixedLimiter(rate), 0)
+}
+
+// WithLimiter tunes the pipe concurrency using the limiter every window, a zero window keeps the initial limit.
+func WithLimiter(limiter Limiter, window time.Duration) WorkerOption {
 	return WorkerOption(func(w *Worker) {
-		w.fixedRate = false
-		w.concurrencyStartingPoint = start
-		w.minConcurrency = min
-		w.dynamicRateBatchWindow = windowSize
+		w.limiter = limiter
+		w.rateWindow = window
 	})
 }
 
-func WithFixedRate(rate int) WorkerOption {
+// WithThroughputLimit limits the messages per second dispatched by the pipe.
+func WithThroughputLimit(perSecond float64, burst int) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.throughput = newThroughputLimiter(perSecond, burst)
+	})
+}
+
+// WithSourceThroughputLimit limits the messages per second read from one of the pipe sources.
+func WithSourceThroughputLimit(source string, perSecond float64, burst int) WorkerOption {
 	return WorkerOption(func(w *Worker) {
-		w.fixedRate = true
-		w.concurrencyStartingPoint = rate
+		if w.sourceThroughput == nil {
+			w.sourceThroughput = map[string]*rate.Limiter{}
+		}
+		w.sourceThroughput[source] = newThroughputLimiter(perSecond, burst)
 	})
 }
 
@@ -51,6 +103,121 @@ func WithErrorSource(source *v1.Source) WorkerOption {
 	})
 }
 
+// WithErrorEnvelope wraps messages written to the error source with their failure context.
+func WithErrorEnvelope() WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.errorEnvelope = true
+	})
+}
+
+// WithEnvelopeUnwrap passes the original message of consumed envelopes to the handler.
+func WithEnvelopeUnwrap() WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.unwrapEnvelope = true
+	})
+}
+
+func WithRetryPolicy(policy *RetryPolicy) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.retryPolicy = policy
+		w.redeliveries = newRedeliveries(maxRedeliveries)
+	})
+}
+
+// WithBatch sends up to size messages of a source in a single handler call, waiting at most window for a batch to fill.
+// The handler must implement handlers.BatchHandler.
+func WithBatch(size int, window time.Duration) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.batchSize = size
+		w.batchWindow = window
+	})
+}
+
+// WithCoalescing groups message completes and output writes made within window into batches of up to size,
+// for sources that support batches.
+func WithCoalescing(size int, window time.Duration) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.coalesceSize = size
+		w.coalesceWindow = window
+	})
+}
+
+// WithOrdering handles messages with the same key one at a time in the order they were received,
+// messages with different keys are handled concurrently. No more messages are received while buffer messages wait.
+// Aborted messages release their key, so ordering only holds across failures with in process retries.
+func WithOrdering(key *utils.KeyExpression, buffer int) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.ordering = key
+		w.orderingBuffer = buffer
+	})
+}
+
+// WithHeartbeat extends the lease of in flight messages every interval.
+func WithHeartbeat(interval time.Duration) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.heartbeatInterval = interval
+	})
+}
+
+// WithDrainTimeout limits the time in flight messages are given to complete on shutdown.
+func WithDrainTimeout(timeout time.Duration) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.drainTimeout = timeout
+	})
+}
+
+// WithRoute adds a handler response route, routes are matched in the order they were added.
+func WithRoute(route *Route) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.routes = append(w.routes, route)
+	})
+}
+
+// WithFilter sends only messages that match the filter to the handler.
+func WithFilter(filter *Filter) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.filter = filter
+	})
+}
+
+// WithTransforms reshapes requests before they are handled and responses before they are written to the output.
+func WithTransforms(request, response transform.Pipeline) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.requestTransform = request
+		w.responseTransform = response
+	})
+}
+
+// WithRouter writes handler responses to the destinations picked by the router instead of a single output.
+func WithRouter(router *Router) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.router = router
+	})
+}
+
+// WithSplit handles every item of the json array at the path as a request, the message is completed once
+// all of the items were completed. An empty path splits a json array message.
+func WithSplit(path string) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.split = true
+		w.splitPath = path
+	})
+}
+
+// WithAggregate writes handler responses to the output in groups, messages are completed once their group was written.
+func WithAggregate(aggregate *Aggregate) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.aggregate = aggregate
+	})
+}
+
+// WithDeduplication completes messages that were already processed without handling them.
+func WithDeduplication(dedup *Deduplication) WorkerOption {
+	return WorkerOption(func(w *Worker) {
+		w.dedup = dedup
+	})
+}
+
 func WithOutput(source *v1.Source) WorkerOption {
 	return WorkerOption(func(w *Worker) {
 		w.output = source
@@ -60,14 +227,18 @@ func WithOutput(source *v1.Source) WorkerOption {
 func NewWorker(name string, sources []*v1.Source, handler handlers.Handler, opts ...WorkerOption) *Worker {
 	l := log.With().Str("scope", "Worker").Str("pipe", name).Logger()
 	w := &Worker{
-		Name:    name,
-		sources: sources,
-		handler: handler,
-		logger:  &l,
-		probe:   health.MakeProbe(),
+		Name:         name,
+		sources:      sources,
+		handler:      handler,
+		logger:       &l,
+		limiter:      NewHillClimbLimiter(10, 1, 0),
+		rateWindow:   30 * time.Second,
+		drainTimeout: 30 * time.Second,
+		probe:        health.MakeProbe(),
 	}
 	for _, o := range opts {
 		o(w)
 	}
+	w.probe.Register(w.handler, "handler")
 	return w
 }
@@ -3,9 +3,10 @@ package pipe
 import (
 	"context"
 	"strconv"
-	"sync/atomic"
+	"sync"
 	"time"
 
+	"github.com/soluto/dqd/handlers"
 	"github.com/soluto/dqd/metrics"
 	v1 "github.com/soluto/dqd/v1"
 )
@@ -13,239 +14,512 @@ import (
 func (w *Worker) handleErrorRequest(ctx *v1.RequestContext, err error, errProducer v1.Producer) {
 	m := ctx.Message()
 	w.logger.Warn().Err(err).Msg("Failed to handle messge")
+	if w.retryPolicy != nil {
+		w.retryOrGiveUp(ctx, err, errProducer)
+		return
+	}
 	if !m.Abort(err) {
+		// The message reached its delivery limit, once written to the error source it is removed from the source
 		if w.writeToErrorSource && errProducer != nil {
-			err = errProducer.Produce(ctx, &v1.RawMessage{Data: m.Data()})
+			w.deadLetter(ctx, err, errProducer)
+			return
 		}
-		if err != nil {
-			w.logger.Error().Err(err).Msg("Failed to abort or recover message")
+		w.logger.Error().Err(err).Msg("Failed to abort or recover message")
+	}
+}
+
+// deadLetter writes the message to the error source and completes it.
+func (w *Worker) deadLetter(ctx *v1.RequestContext, err error, errProducer v1.Producer) {
+	w.logger.Warn().Err(err).Msg("Dead lettering message")
+	w.redeliveries.forget(ctx.Message())
+	err = w.produceError(ctx, err, errProducer)
+	if err == nil {
+		err = w.complete(ctx)
+	}
+	if err != nil {
+		w.logger.Error().Err(err).Msg("Failed to dead letter message")
+	}
+}
+
+func (w *Worker) produceError(ctx *v1.RequestContext, err error, errProducer v1.Producer) error {
+	m := ctx.Message()
+	message := &v1.RawMessage{Data: m.Data(), Metadata: m.Metadata()}
+	if w.errorEnvelope {
+		envelope := &v1.Envelope{
+			Error:      err.Error(),
+			Pipe:       w.Name,
+			Source:     ctx.Source(),
+			MessageId:  m.Id(),
+			Attempts:   ctx.Attempts(),
+			DequeuedAt: ctx.DequeueTime(),
+			FailedAt:   time.Now(),
+			Message:    message,
 		}
+		if handlerErr, ok := err.(handlers.HandlerError); ok {
+			envelope.Code = int(handlerErr.Code())
+		}
+		if c, ok := m.(v1.DeliveryCounter); ok {
+			envelope.DeliveryCount = c.DeliveryCount()
+		}
+		var wrapErr error
+		if message, wrapErr = envelope.Wrap(); wrapErr != nil {
+			return wrapErr
+		}
+	}
+	return errProducer.Produce(ctx, message)
+}
+
+func (w *Worker) handleRequest(ctx *v1.RequestContext) (*v1.RawMessage, error) {
+	request, err := w.transformRequest(ctx.Request())
+	if err != nil {
+		return nil, err
+	}
+	result, err := w.callHandler(ctx, request)
+	if err != nil || result == nil {
+		return result, err
 	}
+	return w.transformResponse(result)
 }
 
-func (w *Worker) handleRequest(ctx *v1.RequestContext) (_ *v1.RawMessage, err error) {
+func (w *Worker) callHandler(ctx *v1.RequestContext, request v1.Message) (_ *v1.RawMessage, err error) {
 	start := time.Now()
 	defer func() {
 		source := ctx.Source()
 		t := float64(time.Since(start)) / float64(time.Second)
 		metrics.HandlerProcessingHistogram.WithLabelValues(w.Name, source, strconv.FormatBool(err == nil)).Observe(t)
+		w.window.observe(time.Since(start), w.pool.Active(), handlers.IsBackpressure(err))
 	}()
-	return w.handler.Handle(ctx, ctx.Message())
+	return w.handler.Handle(ctx, request)
 }
 
-func (w *Worker) handleResults(ctx context.Context, results chan *v1.RequestContext) error {
+func (w *Worker) handleResults(ctx context.Context, results chan *v1.RequestContext) {
 	var outputP v1.Producer
 	var errorP v1.Producer
 	if w.output != nil {
-		outputP = w.output.CreateProducer()
+		outputP = w.coalesceProducer(ctx, w.output.CreateProducer())
+		w.probe.Register(outputP, "output")
 	}
 	if w.errorSource != nil {
-		errorP = w.errorSource.CreateProducer()
+		errorP = w.coalesceProducer(ctx, w.errorSource.CreateProducer())
+		w.probe.Register(errorP, "errorSource")
+	}
+	routerProducers := w.createRouterProducers(ctx)
+	var agg *aggregator
+	if w.aggregate != nil {
+		agg = newAggregator(w.aggregate, func(reqCtx *v1.RequestContext, m *v1.RawMessage) error {
+			if w.router != nil {
+				return w.routeResponse(reqCtx, m, routerProducers)
+			}
+			if outputP == nil {
+				return nil
+			}
+			return outputP.Produce(reqCtx, m)
+		})
 	}
-	done := make(chan error)
-	defer close(done)
-	for reqCtx := range results {
+	routeProducers := make([]v1.Producer, len(w.routes))
+	for i, r := range w.routes {
+		if r.Source != nil {
+			routeProducers[i] = w.coalesceProducer(ctx, r.Source.CreateProducer())
+		}
+	}
+	for {
+		var reqCtx *v1.RequestContext
 		select {
-		case err := <-done:
-			return err
 		case <-ctx.Done():
-			return nil
-		default:
+			return
+		case reqCtx = <-results:
 		}
 		go func(reqCtx *v1.RequestContext) {
+			defer w.inflight.Done()
+			var releaseOnce sync.Once
+			release := func() { releaseOnce.Do(func() { w.releaseOrdering(reqCtx) }) }
+			defer release()
 			m, err := reqCtx.Result()
+			if err == errDuplicate || err == errInFlight {
+				w.settleDuplicate(reqCtx, err)
+				return
+			}
+			processed := false
 			defer func() {
-				defer func() {
-					t := float64(time.Since(reqCtx.DequeueTime())) / float64(time.Second)
-					metrics.PipeProcessingMessagesHistogram.WithLabelValues(w.Name, reqCtx.Source(), strconv.FormatBool(err == nil)).Observe(t)
-				}()
-				if err != nil {
-					w.handleErrorRequest(reqCtx, err, errorP)
+				w.settleReservation(reqCtx, processed)
+				if processed {
+					w.redeliveries.forget(reqCtx.Message())
 				}
 			}()
+			defer func() {
+				t := float64(time.Since(reqCtx.DequeueTime())) / float64(time.Second)
+				metrics.PipeProcessingMessagesHistogram.WithLabelValues(w.Name, reqCtx.Source(), strconv.FormatBool(err == nil)).Observe(t)
+			}()
 
+			outputP, errorP := outputP, errorP
+			overridden := false
+			action := RouteComplete
 			if err != nil {
-				return
+				action = RouteRetry
 			}
-			err = reqCtx.Complete()
-			if err != nil {
-				return
+			status := resultStatus(m, err)
+			i, route := w.matchRoute(status)
+			if retryAfter, throttled := handlers.IsThrottled(err); throttled {
+				// The pipe is paused either way, routes of throttled statuses decide what happens to the message
+				if route == nil {
+					w.handleThrottledRequest(reqCtx, err, retryAfter)
+					return
+				}
+				w.pause(retryAfter)
 			}
-			if m != nil && outputP != nil {
-				err := outputP.Produce(reqCtx, m)
+			if route != nil {
+				action = route.Action
+				if routeProducers[i] != nil {
+					if action == RouteDeadLetter {
+						errorP = routeProducers[i]
+					} else {
+						outputP = routeProducers[i]
+						overridden = true
+					}
+				}
+			}
+
+			switch action {
+			case RouteRetry:
+				if err == nil {
+					err = routeError(status)
+				}
+				w.handleErrorRequest(reqCtx, err, errorP)
+			case RouteDeadLetter:
+				if err == nil {
+					err = routeError(status)
+				}
+				w.deadLetter(reqCtx, err, errorP)
+			case RouteDrop:
+				err = w.complete(reqCtx)
 				if err != nil {
+					w.handleErrorRequest(reqCtx, err, errorP)
+					return
+				}
+				processed = true
+			default:
+				if m != nil && agg != nil && !overridden {
+					// The response was handled, the next message with the same key doesn't wait for the group
+					release()
+					stopExtending := w.extendWhileParked(reqCtx)
+					err = agg.add(reqCtx, m)
+					stopExtending()
+					if err != nil {
+						w.handleErrorRequest(reqCtx, err, errorP)
+						return
+					}
+					if err = w.complete(reqCtx); err != nil {
+						w.handleErrorRequest(reqCtx, err, errorP)
+						return
+					}
+					processed = true
 					return
 				}
+				if m != nil && w.router != nil && !overridden {
+					if err = w.routeResponse(reqCtx, m, routerProducers); err != nil {
+						w.handleErrorRequest(reqCtx, err, errorP)
+						return
+					}
+				}
+				err = w.complete(reqCtx)
+				if err != nil {
+					w.handleErrorRequest(reqCtx, err, errorP)
+					return
+				}
+				processed = true
+				if m != nil && (w.router == nil || overridden) && outputP != nil {
+					if outputErr := outputP.Produce(reqCtx, m); outputErr != nil {
+						w.logger.Error().Err(outputErr).Msg("Failed to write handler response to output")
+					}
+				}
 			}
 		}(reqCtx)
 	}
-	return nil
 }
 
 func (w *Worker) HealthStatus() v1.HealthStatus {
 	return w.probe.HealthStatus()
 }
 
+// Liveness reports whether the pipe is still running, regardless of the handler and sources health.
+func (w *Worker) Liveness() v1.HealthStatus {
+	if err, _ := w.stopped.Load().(error); err != nil {
+		return v1.NewHealthStatus(v1.Error(err))
+	}
+	return v1.NewHealthStatus(v1.Healthy)
+}
+
 func (w *Worker) waitForHandlerToBeReady(ctx context.Context) {
 	for {
 		if ctx.Err() != nil {
 			return
 		}
-		status := w.handler.HealthStatus()
-		w.probe.UpdateStatus(status, "handler")
-		if status.IsHealthy() {
+		if w.handler.HealthStatus().IsHealthy() {
 			return
 		}
 		time.Sleep(time.Duration(time.Second))
 	}
 }
 
-func (w *Worker) readMessages(ctx context.Context, messages chan *v1.RequestContext, results chan *v1.RequestContext) error {
+// tune updates the pool size from the limiter at the end of every rate window.
+func (w *Worker) tune(ctx context.Context) {
 	maxConcurrencyGauge := metrics.WorkerMaxConcurrencyGauge.WithLabelValues(w.Name)
 	batchSizeGauge := metrics.WorkerBatchSizeGauge.WithLabelValues(w.Name)
 
-	var count, lastBatch int64
-	maxItems := int64(w.concurrencyStartingPoint)
-	minConcurrency := int64(w.minConcurrency)
+	maxConcurrencyGauge.Set(float64(w.limiter.Limit()))
+	if w.rateWindow <= 0 {
+		return
+	}
 
-	maxConcurrencyGauge.Set(float64(maxItems))
+	ticker := time.NewTicker(w.rateWindow)
+	defer ticker.Stop()
+	w.logger.Debug().Int("concurrency", w.limiter.Limit()).Msg("Using dynamic concurrency")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-	w.waitForHandlerToBeReady(ctx)
-	if ctx.Err() == context.Canceled {
-		return nil
+		window := w.window.reset()
+		batchSizeGauge.Set(float64(window.Count))
+
+		limit := w.limiter.Update(window)
+		w.pool.Resize(limit)
+		maxConcurrencyGauge.Set(float64(limit))
+
+		w.logger.Debug().Int("concurrency", limit).Float64("rate", float64(window.Count)/w.rateWindow.Seconds()).Dur("latency", window.AverageLatency()).Msg("tuning concurrency")
 	}
+}
 
-	//TODO #15 Consider replacing this code with a goroutine pool library
-	go func() {
-		for message := range messages {
+func (w *Worker) dispatch(ctx context.Context, messages chan *v1.RequestContext, results chan *v1.RequestContext) {
+	inflightGauge := metrics.WorkerInflightGauge.WithLabelValues(w.Name)
+
+	go w.tune(ctx)
+	if w.batchSize > 0 {
+		w.dispatchBatches(ctx, messages, results)
+		return
+	}
+
+	for {
+		var message *v1.RequestContext
+		select {
+		case <-ctx.Done():
+			return
+		case message = <-messages:
+		}
+		if w.waitForPause(ctx, message.Source()) != nil {
+			return
+		}
+		if w.throttle(ctx, w.throughput, message.Source()) != nil {
+			return
+		}
+		if w.pool.Acquire(ctx) != nil {
+			return
+		}
+		metrics.WorkerQueueingDelayHistogram.WithLabelValues(w.Name, message.Source()).Observe(time.Since(message.DequeueTime()).Seconds())
+		inflightGauge.Inc()
+
+		go func(r *v1.RequestContext) {
+			var result *v1.RawMessage
+			attempts := 0
+			err := w.reserve(r)
+			if err == nil {
+				stopHeartbeat := w.startHeartbeat(r)
+				result, attempts, err = w.handleRequestWithRetries(r)
+				stopHeartbeat()
+			}
+			w.pool.Release()
+			inflightGauge.Dec()
 			select {
 			case <-ctx.Done():
-				return
-			default:
-			}
-			for count >= maxItems {
-				time.Sleep(10 * time.Millisecond)
+			case results <- r.WithAttempts(attempts).WithResult(result, err):
 			}
+		}(message)
+	}
+}
 
-			atomic.AddInt64(&count, 1)
-
-			go func(r *v1.RequestContext) {
-				result, err := w.handleRequest(r)
-				atomic.AddInt64(&count, -1)
-				if !w.fixedRate {
-					atomic.AddInt64(&lastBatch, 1)
-				}
-				select {
-				case <-ctx.Done():
-				default:
-					results <- r.WithResult(result, err)
-				}
+// createConsumers creates the consumer of every source along with its complete coalescer, the completers map
+// is read only once messages are consumed.
+func (w *Worker) createConsumers(processCtx context.Context) []v1.Consumer {
+	w.completers = map[string]*coalescer{}
+	consumers := make([]v1.Consumer, len(w.sources))
+	for i, s := range w.sources {
+		consumers[i] = s.CreateConsumer()
+		if consumers[i] == nil {
+			// Output only sources such as stdout don't have consumers
+			continue
+		}
+		w.probe.Register(consumers[i], "sources."+s.Name)
+		if completer, ok := consumers[i].(v1.BatchCompleter); ok && w.coalesceWindow > 0 {
+			w.completers[s.Name] = newCompleteCoalescer(processCtx, completer, w.coalesceSize, w.coalesceWindow)
+		}
+	}
+	return consumers
+}
 
-			}(message)
+// consume reads messages from all sources until ctx is done, requests are created with processCtx.
+func (w *Worker) consume(ctx context.Context, processCtx context.Context, consumers []v1.Consumer, messages chan *v1.RequestContext, errs chan error) {
+	var filterP, errorP v1.Producer
+	if w.filter != nil && w.filter.Source != nil {
+		filterP = w.coalesceProducer(processCtx, w.filter.Source.CreateProducer())
+	}
+	if w.errorSource != nil {
+		errorP = w.coalesceProducer(processCtx, w.errorSource.CreateProducer())
+	}
+	for i, s := range w.sources {
+		consumer := consumers[i]
+		if consumer == nil {
+			w.logger.Warn().Str("source", s.Name).Msg("Source can't be read from, it is only written to")
+			continue
 		}
-	}()
+		w.consuming.Add(1)
+		go func(ss *v1.Source, consumer v1.Consumer) {
+			defer w.consuming.Done()
+			w.logger.Info().Str("source", ss.Name).Msg("Start reading from source")
 
-	// Handle throughput
-	if !w.fixedRate {
-		go func() {
-			var prev int64
-			timer := time.NewTimer(w.dynamicRateBatchWindow)
-			shouldUpscale := true
-			w.logger.Debug().Int64("concurrency", maxItems).Msg("Using dynamic concurrency")
-			for {
-				timer.Reset(w.dynamicRateBatchWindow)
-
-				select {
-				case <-ctx.Done():
+			err := consumer.Iter(ctx, v1.NextMessage(func(m v1.Message) {
+				// The message was already received, it is handled even if the wait is cut by shutdown
+				w.throttle(ctx, w.sourceThroughput[ss.Name], ss.Name)
+				w.inflight.Add(1)
+				r := w.createRequestContext(processCtx, ss.Name, m)
+				if invalid, ok := m.(v1.InvalidMessage); ok && invalid.Invalid() != nil {
+					go w.failRequest(r, handlers.BadRequestError(invalid.Invalid()), errorP)
 					return
-				case <-timer.C:
 				}
-
-				curr := atomic.SwapInt64(&lastBatch, 0)
-				batchSizeGauge.Set(float64(curr))
-
-				if curr == 0 {
-					continue
+				if w.filter != nil && !w.filter.matches(r.Request()) {
+					go w.handleMismatch(r, filterP)
+					return
 				}
-				if curr < prev {
-					shouldUpscale = !shouldUpscale
+				if !w.split {
+					messages <- r
+					return
 				}
-				if shouldUpscale {
-					atomic.AddInt64(&maxItems, 1)
-				} else if maxItems > minConcurrency {
-					atomic.AddInt64(&maxItems, -1)
+				children, err := w.splitRequest(processCtx, r)
+				if err != nil {
+					go w.failRequest(r, err, errorP)
+					return
 				}
-				maxConcurrencyGauge.Set(float64(maxItems))
-
-				prev = curr
-				w.logger.Debug().Int64("concurrency", maxItems).Float64("rate", float64(curr)/w.dynamicRateBatchWindow.Seconds()).Msg("tuning concurrency")
-			}
-		}()
-	}
-	done := make(chan error)
-	defer close(done)
-
-	for _, s := range w.sources {
-		go func(ss *v1.Source) {
-			w.logger.Info().Str("source", ss.Name).Msg("Start reading from source")
-			consumer := ss.CreateConsumer()
-
-			err := consumer.Iter(ctx, v1.NextMessage(func(m v1.Message) {
-				select {
-				case <-ctx.Done():
-				default:
-					messages <- v1.CreateRequestContext(ctx, ss.Name, m)
+				if len(children) == 0 {
+					go w.completeEmpty(r)
+					return
+				}
+				w.inflight.Add(len(children) - 1)
+				for _, child := range children {
+					messages <- child
 				}
 			}))
-			select {
-			case <-ctx.Done():
-			default:
-				done <- err
+			if err != nil && ctx.Err() == nil {
+				errs <- err
 			}
-		}(s)
-	}
-	select {
-	case err := <-done:
-		return err
-	case <-ctx.Done():
-		return nil
+		}(s, consumer)
 	}
 }
 
-func (w *Worker) Start(ctx context.Context) error {
-	w.logger.Info().Msg("Starting pipe")
-	messages := make(chan *v1.RequestContext, w.minConcurrency)
-	defer close(messages)
-	results := make(chan *v1.RequestContext, w.minConcurrency)
-	defer close(results)
-	done := make(chan error)
-
-	innerContext, cancel := context.WithCancel(ctx)
-	defer cancel()
+// drain waits for consumers to stop and for in flight messages to be completed or aborted.
+func (w *Worker) drain() {
+	deadline := time.Now().Add(w.drainTimeout)
+	w.logger.Info().Dur("timeout", w.drainTimeout).Msg("Draining pipe")
+	if !waitUntil(&w.consuming, deadline) {
+		w.logger.Warn().Msg("Timed out waiting for sources to stop")
+		return
+	}
+	if !waitUntil(&w.inflight, deadline) {
+		w.logger.Warn().Msg("Timed out waiting for in flight messages")
+		return
+	}
+	w.logger.Info().Msg("Pipe drained")
+}
 
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
 	go func() {
-		err := w.readMessages(innerContext, messages, results)
-		select {
-		case <-ctx.Done():
-		default:
-			done <- err
-		}
+		wg.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
 
-	go func() {
-		err := w.handleResults(innerContext, results)
-		select {
-		case <-ctx.Done():
-		default:
-			done <- err
+func (w *Worker) createRequestContext(ctx context.Context, source string, m v1.Message) *v1.RequestContext {
+	r := v1.CreateRequestContext(ctx, source, m)
+	if w.unwrapEnvelope {
+		payload, err := v1.UnwrapEnvelope(m.Data())
+		if err != nil {
+			w.logger.Warn().Err(err).Str("source", source).Msg("Failed to unwrap envelope, sending along original message instead")
+			return r
+		}
+		return r.WithPayload(payload)
+	}
+	return r
+}
+
+func (w *Worker) Start(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			w.stopped.Store(err)
 		}
 	}()
+	w.logger.Info().Msg("Starting pipe")
+	messages := make(chan *v1.RequestContext, w.limiter.Limit())
+	results := make(chan *v1.RequestContext, w.limiter.Limit())
+	errs := make(chan error, len(w.sources))
 
-	select {
+	// Requests outlive ctx so in flight messages can be drained on shutdown
+	processCtx, cancelProcessing := context.WithCancel(context.Background())
+	defer cancelProcessing()
 
-	case <-ctx.Done():
+	w.waitForHandlerToBeReady(ctx)
+	if ctx.Err() != nil {
 		return nil
-	case err := <-done:
-		return err
+	}
+
+	consumeCtx, cancelConsume := context.WithCancel(ctx)
+	defer cancelConsume()
+
+	w.pool = newPool(w.limiter.Limit())
+	consumers := w.createConsumers(processCtx)
+	dispatched := messages
+	if w.ordering != nil {
+		w.orderingDone = make(chan string)
+		dispatched = make(chan *v1.RequestContext, w.limiter.Limit())
+		go w.order(processCtx, messages, dispatched)
+	}
+	go w.dispatch(processCtx, dispatched, results)
+	go w.handleResults(processCtx, results)
+	w.consume(consumeCtx, processCtx, consumers, messages, errs)
+
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	cancelConsume()
+	w.drain()
+	w.closeConsumers(consumers)
+	if closer, ok := w.handler.(handlers.HandlerCloser); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			w.logger.Warn().Err(closeErr).Msg("Failed to close handler")
+		}
+	}
+	if w.dedup != nil {
+		if closeErr := w.dedup.Store.Close(); closeErr != nil {
+			w.logger.Warn().Err(closeErr).Msg("Failed to close deduplication store")
+		}
+	}
+	return err
+}
+
+// closeConsumers releases the consumers after in flight messages were settled.
+func (w *Worker) closeConsumers(consumers []v1.Consumer) {
+	for i, consumer := range consumers {
+		if closer, ok := consumer.(v1.ConsumerCloser); ok {
+			if err := closer.Close(); err != nil {
+				w.logger.Warn().Err(err).Str("source", w.sources[i].Name).Msg("Failed to close source")
+			}
+		}
 	}
 }
@@ -0,0 +1,26 @@
+package pipe
+
+import (
+	"context"
+	"testing"
+
+	"github.com/soluto/dqd/health"
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+	"github.com/spf13/viper"
+)
+
+func TestSourcesWithoutConsumers(t *testing.T) {
+	w := newTestWorker()
+	w.probe = health.MakeProbe()
+	w.sources = []*v1.Source{v1.NewSource(&utils.IoSourceFactory{}, &utils.IoSourceFactory{}, viper.New(), "stdout")}
+	consumers := w.createConsumers(context.Background())
+	if status := w.HealthStatus(); !status.IsHealthy() {
+		t.Fatalf("expected output only sources not to be health checked, got %v", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.consume(ctx, context.Background(), consumers, make(chan *v1.RequestContext), make(chan error, 1))
+	w.consuming.Wait()
+}
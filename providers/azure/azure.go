@@ -3,6 +3,8 @@ package azure
 import (
 	"encoding/base64"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-pipeline-go/pipeline"
@@ -21,28 +23,53 @@ const (
 	serverTimeout = 5
 )
 
+// Message text encodings, text is written as is and base64 is the encoding of the azure sdks.
+const (
+	encodingBase64 = "base64"
+	encodingText   = "text"
+)
+
 // Message represents a message in a queue.
 type AzureMessage struct {
 	*azqueue.DequeuedMessage
 	azureClient *azureClient
+	data        []byte
+	decodeErr   error
+	// guards the pop receipt, which is replaced on every update
+	lock sync.Mutex
 }
 
 type azureClient struct {
-	messagesURL       azqueue.MessagesURL
-	MaxDequeueCount   int64
-	visibilityTimeout time.Duration
-	logger            *zerolog.Logger
+	messagesURL            azqueue.MessagesURL
+	MaxDequeueCount        int64
+	visibilityTimeout      time.Duration
+	retryVisibilityTimeout []time.Duration
+	messageEncoding        string
+	logger                 *zerolog.Logger
+	queueURL               azqueue.QueueURL
+	health                 *v1.HealthTracker
 }
 
-func (m *AzureMessage) Data() string {
-	decoded, err := base64.StdEncoding.DecodeString(m.Text)
-	if err == nil {
-		return string(decoded)
+func (m *AzureMessage) Data() []byte {
+	return m.data
+}
+
+// Invalid returns the decoding error of base64 messages that aren't base64.
+func (m *AzureMessage) Invalid() error {
+	return m.decodeErr
+}
+
+func (m *AzureMessage) Metadata() v1.Metadata {
+	return v1.Metadata{
+		v1.MetadataDequeueCount:   strconv.FormatInt(m.DequeueCount, 10),
+		v1.MetadataInsertionTime:  m.InsertionTime.UTC().Format(time.RFC3339),
+		v1.MetadataExpirationTime: m.ExpirationTime.UTC().Format(time.RFC3339),
 	}
-	return m.Text
 }
 
 func (m *AzureMessage) Complete() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	res, err := m.azureClient.messagesURL.NewMessageIDURL(azqueue.MessageID(m.Id())).Delete(context.Background(), azqueue.PopReceipt(m.PopReceipt))
 	if err != nil {
 		return err
@@ -53,12 +80,58 @@ func (m *AzureMessage) Complete() error {
 	return nil
 }
 
+// CompleteBatch deletes the messages concurrently, azure queues don't have a batch delete.
+func (c *azureClient) CompleteBatch(messages []v1.Message) []error {
+	errs := make([]error, len(messages))
+	var wg sync.WaitGroup
+	for i, m := range messages {
+		wg.Add(1)
+		go func(i int, m v1.Message) {
+			defer wg.Done()
+			errs[i] = m.Complete()
+		}(i, m)
+	}
+	wg.Wait()
+	return errs
+}
+
 func (m *AzureMessage) Id() string {
 	return m.ID.String()
 }
 
 func (m *AzureMessage) Abort(error) bool {
-	return m.DequeueCount < m.azureClient.MaxDequeueCount
+	if m.DequeueCount >= m.azureClient.MaxDequeueCount {
+		return false
+	}
+	if retries := m.azureClient.retryVisibilityTimeout; len(retries) > 0 {
+		i := int(m.DequeueCount) - 1
+		if i >= len(retries) {
+			i = len(retries) - 1
+		}
+		if err := m.Defer(retries[i]); err != nil {
+			m.azureClient.logger.Warn().Err(err).Str("id", m.Id()).Msg("Failed updating message visibility")
+		}
+	}
+	return true
+}
+
+func (m *AzureMessage) DeliveryCount() int64 {
+	return m.DequeueCount
+}
+
+func (m *AzureMessage) ExtendLease() error {
+	return m.Defer(m.azureClient.visibilityTimeout)
+}
+
+func (m *AzureMessage) Defer(delay time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res, err := m.azureClient.messagesURL.NewMessageIDURL(m.ID).Update(context.Background(), m.PopReceipt, delay, m.Text)
+	if err != nil {
+		return err
+	}
+	m.PopReceipt = res.PopReceipt
+	return nil
 }
 
 type ClientOptions struct {
@@ -67,9 +140,33 @@ type ClientOptions struct {
 	VisibilityTimeoutInSeconds     int64
 }
 
+// Produce enqueues the message data, azure queues have no message properties so metadata is not written.
 func (c *azureClient) Produce(context context.Context, m *v1.RawMessage) error {
-	_, err := c.messagesURL.Enqueue(context, m.Data, time.Duration(0), time.Duration(0))
-	return err
+	_, err := c.messagesURL.Enqueue(context, c.encode(m.Data), time.Duration(0), time.Duration(0))
+	return c.health.Track(err)
+}
+
+func (c *azureClient) encode(data []byte) string {
+	if c.messageEncoding == encodingText {
+		return string(data)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func (c *azureClient) newMessage(azM *azqueue.DequeuedMessage) *AzureMessage {
+	message := &AzureMessage{
+		DequeuedMessage: azM,
+		azureClient:     c,
+		data:            []byte(azM.Text),
+	}
+	if c.messageEncoding == encodingBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(azM.Text)
+		if err != nil {
+			message.decodeErr = fmt.Errorf("invalid base64 message: %v", err)
+		}
+		message.data = decoded
+	}
+	return message
 }
 
 func (c *azureClient) Iter(ctx context.Context, next v1.NextMessage) error {
@@ -83,10 +180,14 @@ Main:
 		default:
 		}
 
-		messages, err := c.messagesURL.Dequeue(context.Background(), 32, c.visibilityTimeout)
+		messages, err := c.messagesURL.Dequeue(ctx, 32, c.visibilityTimeout)
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				break Main
+			}
+			return c.health.Track(err)
 		}
+		c.health.Track(nil)
 		messagesCount := messages.NumMessages()
 
 		if messagesCount == 0 {
@@ -96,18 +197,10 @@ Main:
 		}
 		backoff.Reset()
 
+		// Received messages are handled even on shutdown, they would stay invisible until their visibility timeout
 		for i := int32(0); i < messages.NumMessages(); i++ {
-			select {
-			case <-ctx.Done():
-				break Main
-			default:
-			}
 			azM := messages.Message(i)
-			message := &AzureMessage{
-				azM,
-				c,
-			}
-			next(message)
+			next(c.newMessage(azM))
 		}
 	}
 	return nil
@@ -136,12 +229,25 @@ func translateLogLevel(l pipeline.LogLevel) zerolog.Level {
 func createAuzreQueueClient(cfg *viper.Viper, logger *zerolog.Logger) *azureClient {
 	cfg.SetDefault("visibilityTimeoutInSeconds", 60)
 	cfg.SetDefault("maxDequeueCount", 5)
+	cfg.SetDefault("messageEncoding", encodingText)
+	cfg.SetDefault("healthCheckInterval", 0)
+	if encoding := cfg.GetString("messageEncoding"); encoding != encodingBase64 && encoding != encodingText {
+		panic(fmt.Sprintf("Unknown azure queue message encoding: %v", encoding))
+	}
 
 	storageAccount := cfg.GetString("storageAccount")
 	queueName := cfg.GetString("queue")
 	sasToken := cfg.GetString("sasToken")
 	accountKey := cfg.GetString("storageAccountKey")
 	visibilityTimeout := time.Duration(cfg.GetInt64("visibilityTimeoutInSeconds")) * time.Second
+	var retryVisibilityTimeout []time.Duration
+	for _, t := range cfg.GetStringSlice("retryVisiblityTimeoutInSeconds") {
+		seconds, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			panic(fmt.Errorf("invalid retryVisiblityTimeoutInSeconds value: %v", t))
+		}
+		retryVisibilityTimeout = append(retryVisibilityTimeout, time.Duration(seconds)*time.Second)
+	}
 
 	credentials := azqueue.NewAnonymousCredential()
 	if accountKey != "" && storageAccount != "" {
@@ -175,14 +281,23 @@ func createAuzreQueueClient(cfg *viper.Viper, logger *zerolog.Logger) *azureClie
 	sURL = fmt.Sprintf("%s%s", sURL, sasToken)
 	u, _ := url.Parse(sURL)
 
-	messagesURL := azqueue.NewServiceURL(*u, pipeline).NewQueueURL(queueName).NewMessagesURL()
+	queueURL := azqueue.NewServiceURL(*u, pipeline).NewQueueURL(queueName)
 
-	return &azureClient{
-		messagesURL:       messagesURL,
-		MaxDequeueCount:   cfg.GetInt64("maxDequeueCount"),
-		visibilityTimeout: visibilityTimeout,
-		logger:            logger,
+	client := &azureClient{
+		messagesURL:            queueURL.NewMessagesURL(),
+		queueURL:               queueURL,
+		health:                 &v1.HealthTracker{},
+		MaxDequeueCount:        cfg.GetInt64("maxDequeueCount"),
+		visibilityTimeout:      visibilityTimeout,
+		retryVisibilityTimeout: retryVisibilityTimeout,
+		messageEncoding:        cfg.GetString("messageEncoding"),
+		logger:                 logger,
 	}
+	client.health.WithCheck(cfg.GetDuration("healthCheckInterval"), func(ctx context.Context) error {
+		_, err := client.queueURL.GetProperties(ctx)
+		return err
+	})
+	return client
 }
 
 type AzureQueueClientFactory struct {
@@ -197,5 +312,5 @@ func (factory *AzureQueueClientFactory) CreateProducer(cfg *viper.Viper, logger
 }
 
 func (c *azureClient) HealthStatus() v1.HealthStatus {
-	return v1.NewHealthStatus(v1.Healthy)
+	return c.health.HealthStatus()
 }
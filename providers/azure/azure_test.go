@@ -0,0 +1,28 @@
+package azure
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-storage-queue-go/azqueue"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	text := &azureClient{messageEncoding: encodingText}
+	if m := text.newMessage(&azqueue.DequeuedMessage{Text: "aGVsbG8="}); string(m.Data()) != "aGVsbG8=" || m.Invalid() != nil {
+		t.Fatalf("expected text messages as is, got %q %v", m.Data(), m.Invalid())
+	}
+	if encoded := text.encode([]byte("hello")); encoded != "hello" {
+		t.Fatalf("expected text to be produced as is, got %q", encoded)
+	}
+
+	base64 := &azureClient{messageEncoding: encodingBase64}
+	if m := base64.newMessage(&azqueue.DequeuedMessage{Text: "aGVsbG8="}); string(m.Data()) != "hello" || m.Invalid() != nil {
+		t.Fatalf("expected base64 messages to be decoded, got %q %v", m.Data(), m.Invalid())
+	}
+	if m := base64.newMessage(&azqueue.DequeuedMessage{Text: "hello"}); m.Invalid() == nil {
+		t.Fatal("expected messages that aren't base64 to be invalid")
+	}
+	if encoded := base64.encode([]byte("hello")); encoded != "aGVsbG8=" {
+		t.Fatalf("expected base64 to be produced, got %q", encoded)
+	}
+}
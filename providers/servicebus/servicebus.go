@@ -2,97 +2,428 @@ package servicebus
 
 import (
 	"context"
-	"strings"
+	"fmt"
+	"sync"
+	"time"
 
 	azservicebus "github.com/Azure/azure-service-bus-go"
 	"github.com/rs/zerolog"
+	"github.com/soluto/dqd/transform"
 	v1 "github.com/soluto/dqd/v1"
 	"github.com/spf13/viper"
 )
 
 type ServiceBusClient struct {
-	topic                   *azservicebus.Topic
-	subscription            *azservicebus.Subscription
+	entity                  receivingEntity
+	renewer                 lockRenewer
+	newSession              func(sessionID *string) sessionReceiver
+	send                    func(ctx context.Context, m *azservicebus.Message) error
 	logger                  zerolog.Logger
 	preFetchCount           int
 	removeSerializationInfo bool
+	deadLetterQueue         bool
+	sessions                bool
+	maxConcurrentSessions   int
+	sessionIdleTimeout      time.Duration
+	health                  *v1.HealthTracker
+	receiversLock           sync.Mutex
+	receivers               []azservicebus.ReceiveOner
+}
+
+type lockRenewer interface {
+	RenewLocks(ctx context.Context, messages ...*azservicebus.Message) error
+}
+
+// receivingEntity is a queue or a subscription.
+type receivingEntity interface {
+	lockRenewer
+	NewReceiver(ctx context.Context, opts ...azservicebus.ReceiverOption) (*azservicebus.Receiver, error)
+	NewDeadLetterReceiver(ctx context.Context, opts ...azservicebus.ReceiverOption) (azservicebus.ReceiveOner, error)
+}
+
+// prefetchingQueue applies the prefetch count to the receivers of queue sessions, unlike subscriptions queues
+// don't apply it to the receivers they build.
+type prefetchingQueue struct {
+	*azservicebus.Queue
+	prefetchCount uint32
+}
+
+func (q *prefetchingQueue) NewReceiver(ctx context.Context, opts ...azservicebus.ReceiverOption) (*azservicebus.Receiver, error) {
+	return q.Queue.NewReceiver(ctx, append(opts, azservicebus.ReceiverWithPrefetchCount(q.prefetchCount))...)
+}
+
+type sessionReceiver interface {
+	ReceiveOne(ctx context.Context, handler azservicebus.SessionHandler) error
+	Close(ctx context.Context) error
 }
 
 type ServiceBusMessage struct {
 	message                 *azservicebus.Message
 	removeSerializationInfo bool
+	renewer                 lockRenewer
+	settle                  func()
 }
 
 func createServiceBusClient(cfg *viper.Viper, logger *zerolog.Logger) *ServiceBusClient {
-	cfg.SetDefault("prefetchCount", 1)
+	cfg.SetDefault("prefetchCount", 10)
+	cfg.SetDefault("deadLetterQueue", false)
+	cfg.SetDefault("sessions", false)
+	cfg.SetDefault("maxConcurrentSessions", 1)
+	cfg.SetDefault("sessionIdleTimeout", "10s")
+	cfg.SetDefault("healthCheckInterval", 0)
 	namespace, err := azservicebus.NewNamespace(azservicebus.NamespaceWithConnectionString(cfg.GetString("connectionString")))
+	if err != nil {
+		panic(fmt.Sprintf("failed to initalize service bus client: %v", err))
+	}
+	client := &ServiceBusClient{
+		preFetchCount:           cfg.GetInt("prefetchCount"),
+		removeSerializationInfo: cfg.GetBool("removeSerializationInfoInJson"),
+		deadLetterQueue:         cfg.GetBool("deadLetterQueue"),
+		sessions:                cfg.GetBool("sessions"),
+		maxConcurrentSessions:   cfg.GetInt("maxConcurrentSessions"),
+		sessionIdleTimeout:      cfg.GetDuration("sessionIdleTimeout"),
+		health:                  &v1.HealthTracker{},
+	}
+	healthCheckInterval := cfg.GetDuration("healthCheckInterval")
+	if client.sessions && client.deadLetterQueue {
+		panic("service bus dead letter queues don't support sessions")
+	}
+
+	if queueName := cfg.GetString("queue"); queueName != "" {
+		queue, err := namespace.NewQueue(queueName)
+		if err != nil {
+			panic(fmt.Sprintf("failed to initalize service bus queue: %v", err))
+		}
+		client.logger = logger.With().Str("queue", queueName).Logger()
+		client.entity = queue
+		client.renewer = queue
+		if client.deadLetterQueue {
+			deadLetterQueue, err := namespace.NewQueue(deadLetterPath(queueName))
+			if err != nil {
+				panic(fmt.Sprintf("failed to initalize service bus dead letter queue: %v", err))
+			}
+			client.renewer = deadLetterQueue
+		}
+		prefetching := &prefetchingQueue{queue, uint32(client.preFetchCount)}
+		client.newSession = func(sessionID *string) sessionReceiver {
+			return azservicebus.NewQueueSession(prefetching, sessionID)
+		}
+		client.send = func(ctx context.Context, m *azservicebus.Message) error { return queue.Send(ctx, m) }
+		client.health.WithCheck(healthCheckInterval, func(ctx context.Context) error {
+			_, err := namespace.NewQueueManager().Get(ctx, queueName)
+			return err
+		})
+		return client
+	}
+
 	topicName := cfg.GetString("topic")
 	subscriptionName := cfg.GetString("subscription")
 	topic, err := namespace.NewTopic(topicName)
 	if err != nil {
-		panic("failed to initalize service bus client")
+		panic(fmt.Sprintf("failed to initalize service bus topic: %v", err))
 	}
-	l := logger.With().Str("topic", topicName).Str("subscription", subscriptionName).Logger()
-	subscription, err := topic.NewSubscription(subscriptionName)
-	return &ServiceBusClient{
-		topic,
-		subscription,
-		l,
-		cfg.GetInt("prefetchCount"),
-		cfg.GetBool("removeSerializationInfoInJson"),
+	client.logger = logger.With().Str("topic", topicName).Str("subscription", subscriptionName).Logger()
+	client.send = func(ctx context.Context, m *azservicebus.Message) error { return topic.Send(ctx, m) }
+	if subscriptionName != "" {
+		subscription, err := topic.NewSubscription(subscriptionName, azservicebus.SubscriptionWithPrefetchCount(uint32(client.preFetchCount)))
+		if err != nil {
+			panic(fmt.Sprintf("failed to initalize service bus subscription: %v", err))
+		}
+		client.entity = subscription
+		client.renewer = subscription
+		if client.deadLetterQueue {
+			deadLetterSubscription, err := topic.NewSubscription(deadLetterPath(subscriptionName))
+			if err != nil {
+				panic(fmt.Sprintf("failed to initalize service bus dead letter queue: %v", err))
+			}
+			client.renewer = deadLetterSubscription
+		}
+		client.newSession = func(sessionID *string) sessionReceiver { return subscription.NewSession(sessionID) }
+		client.health.WithCheck(healthCheckInterval, func(ctx context.Context) error {
+			_, err := topic.NewSubscriptionManager().Get(ctx, subscriptionName)
+			return err
+		})
+		return client
 	}
+	client.health.WithCheck(healthCheckInterval, func(ctx context.Context) error {
+		_, err := namespace.NewTopicManager().Get(ctx, topicName)
+		return err
+	})
+	return client
+}
+
+// deadLetterPath is the path of the entity dead letter queue, the locks of dead lettered messages are renewed
+// through its management link rather than the entity's.
+func deadLetterPath(name string) string {
+	return name + "/" + azservicebus.DeadLetterQueueName
 }
 
 func (m *ServiceBusMessage) Id() string {
 	return m.message.ID
 }
 
-func (m *ServiceBusMessage) Data() string {
-	data := string(m.message.Data)
+func (m *ServiceBusMessage) Data() []byte {
+	data := m.message.Data
 	if m.removeSerializationInfo {
-		return strings.TrimRightFunc(strings.TrimLeftFunc(data, func(r rune) bool { return r != '{' && r != '[' }), func(r rune) bool { return r != '}' && r != ']' })
+		if trimmed, err := transform.TrimSerializationInfo().Apply(&v1.RawMessage{Data: data}); err == nil {
+			return trimmed.Data
+		}
 	}
 	return data
 }
 
+func (m *ServiceBusMessage) Metadata() v1.Metadata {
+	metadata := v1.Metadata{}
+	for k, v := range m.message.UserProperties {
+		metadata[k] = fmt.Sprint(v)
+	}
+	if m.message.CorrelationID != "" {
+		metadata[v1.MetadataCorrelationId] = m.message.CorrelationID
+	}
+	if m.message.ContentType != "" {
+		metadata[v1.MetadataContentType] = m.message.ContentType
+	}
+	if m.message.SessionID != nil {
+		metadata[v1.MetadataGroupId] = *m.message.SessionID
+	}
+	return metadata
+}
+
 func (m *ServiceBusMessage) Complete() error {
+	defer m.settle()
 	return m.message.Complete(context.Background())
 }
 
 func (m *ServiceBusMessage) Abort(error) bool {
+	defer m.settle()
 	m.message.Abandon(context.Background())
 	return true
 }
 
+// DeadLetter moves the message to the entity dead letter queue with the error as its reason.
+func (m *ServiceBusMessage) DeadLetter(reason error) error {
+	defer m.settle()
+	return m.message.DeadLetter(context.Background(), reason)
+}
+
+func (m *ServiceBusMessage) ExtendLease() error {
+	return m.renewer.RenewLocks(context.Background(), m.message)
+}
+
+func (m *ServiceBusMessage) DeliveryCount() int64 {
+	return int64(m.message.DeliveryCount)
+}
+
+func (sb *ServiceBusClient) newMessage(m *azservicebus.Message, renewer lockRenewer, settle func()) *ServiceBusMessage {
+	return &ServiceBusMessage{
+		m,
+		sb.removeSerializationInfo,
+		renewer,
+		settle,
+	}
+}
+
 func (sb *ServiceBusClient) Iter(ctx context.Context, next v1.NextMessage) error {
-	rec, err := sb.subscription.NewReceiver(ctx, azservicebus.ReceiverWithReceiveMode(azservicebus.PeekLockMode), azservicebus.ReceiverWithPrefetchCount(10))
+	if sb.entity == nil {
+		return fmt.Errorf("missing service bus queue or subscription")
+	}
+	if sb.sessions {
+		return sb.iterSessions(ctx, next)
+	}
+	opts := []azservicebus.ReceiverOption{
+		azservicebus.ReceiverWithReceiveMode(azservicebus.PeekLockMode),
+		azservicebus.ReceiverWithPrefetchCount(uint32(sb.preFetchCount)),
+	}
+	var rec azservicebus.ReceiveOner
+	var err error
+	if sb.deadLetterQueue {
+		rec, err = sb.entity.NewDeadLetterReceiver(ctx, opts...)
+	} else {
+		rec, err = sb.entity.NewReceiver(ctx, opts...)
+	}
 	if err != nil {
-		return err
+		return sb.health.Track(err)
 	}
+	// The receiver settles the received messages, it is closed by Close once they were drained
+	sb.receiversLock.Lock()
+	sb.receivers = append(sb.receivers, rec)
+	sb.receiversLock.Unlock()
 	for {
 		select {
 		case <-ctx.Done():
-			break
+			return nil
 		default:
-
 		}
 
 		err = rec.ReceiveOne(ctx, azservicebus.HandlerFunc(func(ctx context.Context, m *azservicebus.Message) error {
-			message := &ServiceBusMessage{
-				m,
-				sb.removeSerializationInfo,
-			}
-			next(message)
+			next(sb.newMessage(m, sb.renewer, func() {}))
 			return nil
 		}))
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return nil
+			}
+			return sb.health.Track(err)
+		}
+		sb.health.Track(nil)
+	}
+}
+
+// iterSessions receives from up to maxConcurrentSessions sessions at a time, a session is released once it was
+// idle for sessionIdleTimeout and all of its messages were settled.
+func (sb *ServiceBusClient) iterSessions(ctx context.Context, next v1.NextMessage) error {
+	var wg sync.WaitGroup
+	for i := 0; i < sb.maxConcurrentSessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				session := sb.newSession(nil)
+				handler := &sessionHandler{client: sb, next: next}
+				handler.settled = sync.NewCond(&handler.lock)
+				err := session.ReceiveOne(ctx, handler)
+				handler.waitForSettled()
+				session.Close(context.Background())
+				if ctx.Err() != nil {
+					return
+				}
+				if sb.health.Track(err) != nil {
+					sb.logger.Warn().Err(err).Msg("Failed receiving from session")
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// sessionHandler counts the messages of the session that weren't settled yet, messages received once the
+// session is released are abandoned.
+type sessionHandler struct {
+	client       *ServiceBusClient
+	next         v1.NextMessage
+	session      *azservicebus.MessageSession
+	lock         sync.Mutex
+	settled      *sync.Cond
+	pending      int
+	released     bool
+	lastReceived time.Time
+	done         chan struct{}
+}
+
+func (h *sessionHandler) Start(session *azservicebus.MessageSession) error {
+	h.session = session
+	h.lastReceived = time.Now()
+	h.done = make(chan struct{})
+	go h.closeWhenIdle()
+	return nil
+}
+
+func (h *sessionHandler) closeWhenIdle() {
+	ticker := time.NewTicker(h.client.sessionIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+		h.lock.Lock()
+		idle := time.Since(h.lastReceived) >= h.client.sessionIdleTimeout
+		h.lock.Unlock()
+		if idle {
+			h.session.Close()
+			return
 		}
 	}
 }
 
+func (h *sessionHandler) End() {
+	close(h.done)
+}
+
+func (h *sessionHandler) Handle(ctx context.Context, m *azservicebus.Message) error {
+	h.lock.Lock()
+	if h.released {
+		h.lock.Unlock()
+		return m.Abandon(ctx)
+	}
+	h.lastReceived = time.Now()
+	h.pending++
+	h.lock.Unlock()
+	var once sync.Once
+	h.next(h.client.newMessage(m, &sessionRenewer{h.session}, func() { once.Do(h.settle) }))
+	return nil
+}
+
+func (h *sessionHandler) settle() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.pending--
+	if h.pending == 0 {
+		h.settled.Broadcast()
+	}
+}
+
+// waitForSettled releases the session and waits until its messages were settled.
+func (h *sessionHandler) waitForSettled() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.released = true
+	for h.pending > 0 {
+		h.settled.Wait()
+	}
+}
+
+// sessionRenewer extends the lock of session messages by renewing the session lock.
+type sessionRenewer struct {
+	session *azservicebus.MessageSession
+}
+
+func (r *sessionRenewer) RenewLocks(ctx context.Context, _ ...*azservicebus.Message) error {
+	return r.session.RenewLock(ctx)
+}
+
+// Produce sends the message, the metadata is written as user properties except for the receive metadata.
 func (c *ServiceBusClient) Produce(ctx context.Context, m *v1.RawMessage) error {
-	return c.topic.Send(ctx, azservicebus.NewMessageFromString(m.Data))
+	message := azservicebus.NewMessage(m.Data)
+	for k, v := range m.Metadata {
+		switch k {
+		case v1.MetadataCorrelationId:
+			message.CorrelationID = v
+			continue
+		case v1.MetadataContentType:
+			message.ContentType = v
+			continue
+		case v1.MetadataGroupId:
+			sessionID := v
+			message.SessionID = &sessionID
+			continue
+		}
+		if v1.IsReceiveMetadata(k) {
+			continue
+		}
+		if message.UserProperties == nil {
+			message.UserProperties = map[string]interface{}{}
+		}
+		message.UserProperties[k] = v
+	}
+	return c.health.Track(c.send(ctx, message))
+}
+
+// Close closes the receivers once the messages they received were settled.
+func (sb *ServiceBusClient) Close() error {
+	sb.receiversLock.Lock()
+	defer sb.receiversLock.Unlock()
+	var err error
+	for _, rec := range sb.receivers {
+		if closeErr := rec.Close(context.Background()); closeErr != nil {
+			err = closeErr
+		}
+	}
+	sb.receivers = nil
+	return err
 }
 
 type ServiceBusClientFactory struct {
@@ -107,5 +438,5 @@ func (factory *ServiceBusClientFactory) CreateProducer(cfg *viper.Viper, logger
 }
 
 func (sb *ServiceBusClient) HealthStatus() v1.HealthStatus {
-	return v1.NewHealthStatus(v1.Healthy)
+	return sb.health.HealthStatus()
 }
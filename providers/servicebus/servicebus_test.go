@@ -0,0 +1,94 @@
+package servicebus
+
+import (
+	"context"
+	"testing"
+
+	azservicebus "github.com/Azure/azure-service-bus-go"
+	"github.com/rs/zerolog"
+	v1 "github.com/soluto/dqd/v1"
+	"github.com/spf13/viper"
+)
+
+func producedMessage(t *testing.T, m *v1.RawMessage) *azservicebus.Message {
+	var sent *azservicebus.Message
+	client := &ServiceBusClient{
+		health: &v1.HealthTracker{},
+		send: func(ctx context.Context, m *azservicebus.Message) error {
+			sent = m
+			return nil
+		},
+	}
+	if err := client.Produce(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	return sent
+}
+
+func TestProduceSessionId(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		sent := producedMessage(t, &v1.RawMessage{
+			Data: []byte("{}"),
+			Metadata: v1.Metadata{
+				v1.MetadataGroupId:       "session",
+				v1.MetadataCorrelationId: "correlation",
+				v1.MetadataContentType:   "application/json",
+				"a":                      "1",
+				"b":                      "2",
+			},
+		})
+		if sent.SessionID == nil || *sent.SessionID != "session" {
+			t.Fatalf("expected the group id as session id, got %v", sent.SessionID)
+		}
+		if sent.CorrelationID != "correlation" || sent.ContentType != "application/json" {
+			t.Fatalf("unexpected message properties: %v %v", sent.CorrelationID, sent.ContentType)
+		}
+		if len(sent.UserProperties) != 2 || sent.UserProperties["a"] != "1" {
+			t.Fatalf("unexpected user properties: %v", sent.UserProperties)
+		}
+	}
+}
+
+func TestProduceSkipsReceiveMetadata(t *testing.T) {
+	sent := producedMessage(t, &v1.RawMessage{
+		Data: []byte("{}"),
+		Metadata: v1.Metadata{
+			v1.MetadataDequeueCount:   "3",
+			v1.MetadataInsertionTime:  "2020-01-01T00:00:00Z",
+			v1.MetadataExpirationTime: "2020-01-08T00:00:00Z",
+			v1.MetadataStatusCode:     "200",
+			"sqs-SentTimestamp":       "1577836800000",
+			"tenant":                  "a",
+		},
+	})
+	if len(sent.UserProperties) != 1 || sent.UserProperties["tenant"] != "a" {
+		t.Fatalf("expected only the message metadata to be sent, got %v", sent.UserProperties)
+	}
+}
+
+func TestDeadLetterLockRenewal(t *testing.T) {
+	connection := "Endpoint=sb://test.servicebus.windows.net/;SharedAccessKeyName=test;SharedAccessKey=dGVzdA=="
+	for _, c := range []struct {
+		config   map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"queue": "q"}, "q/$management"},
+		{map[string]interface{}{"queue": "q", "deadLetterQueue": true}, "q/$DeadLetterQueue/$management"},
+		{map[string]interface{}{"topic": "t", "subscription": "s", "deadLetterQueue": true}, "t/subscriptions/s/$DeadLetterQueue/$management"},
+	} {
+		cfg := viper.New()
+		cfg.Set("connectionString", connection)
+		for k, v := range c.config {
+			cfg.Set(k, v)
+		}
+		logger := zerolog.Nop()
+		client := createServiceBusClient(cfg, &logger)
+		renewer, ok := client.renewer.(azservicebus.EntityManagementAddresser)
+		if !ok {
+			t.Fatalf("unexpected renewer %T", client.renewer)
+		}
+		if path := renewer.ManagementPath(); path != c.expected {
+			t.Fatalf("expected locks to be renewed through %v, got %v", c.expected, path)
+		}
+	}
+}
@@ -2,14 +2,22 @@ package sqs
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/jpillora/backoff"
 	"github.com/rs/zerolog"
+	"github.com/soluto/dqd/transform"
+	"github.com/soluto/dqd/utils"
 	v1 "github.com/soluto/dqd/v1"
 	"github.com/spf13/viper"
 )
@@ -21,6 +29,14 @@ type SQSClient struct {
 	maxNumberOfMessages        int64
 	unwrapSnsMessage           bool
 	logger                     *zerolog.Logger
+	waitTimeSeconds            int64
+	maxReceiveCount            int64
+	attributeNames             []*string
+	messageAttributeNames      []*string
+	fifo                       bool
+	messageGroupId             *utils.KeyExpression
+	deduplicationId            *utils.KeyExpression
+	health                     *v1.HealthTracker
 }
 
 type SQSMessage struct {
@@ -28,14 +44,28 @@ type SQSMessage struct {
 	client *SQSClient
 }
 
-type SnsMessage struct {
-	Message string `json:"Message"`
-}
+// maxBatchSize is the maximum number of entries in sqs batch requests.
+const maxBatchSize = 10
+
+// maxMessageAttributes is the maximum number of attributes of an sqs message.
+const maxMessageAttributes = 10
+
+const systemAttributePrefix = v1.MetadataSqsAttributePrefix
+
+// bodyEncodingAttribute marks message bodies that were base64 encoded because sqs only accepts text.
+const bodyEncodingAttribute = "dqd-body-encoding"
 
 func createSQSClient(cfg *viper.Viper, logger *zerolog.Logger) *SQSClient {
 	cfg.SetDefault("visibilityTimeoutInSeconds", 600)
 	cfg.SetDefault("maxNumberOfMessages", 10)
 	cfg.SetDefault("unwrapSnsMessage", false)
+	cfg.SetDefault("waitTimeSeconds", 20)
+	cfg.SetDefault("maxReceiveCount", 0)
+	cfg.SetDefault("attributeNames", []string{sqs.MessageSystemAttributeNameSentTimestamp})
+	cfg.SetDefault("messageAttributeNames", []string{sqs.QueueAttributeNameAll})
+	cfg.SetDefault("messageGroupId", "metadata."+v1.MetadataGroupId)
+	cfg.SetDefault("deduplicationId", "metadata."+v1.MetadataDeduplicationId)
+	cfg.SetDefault("healthCheckInterval", 0)
 
 	awsConfig := aws.NewConfig().WithRegion(cfg.GetString("region"))
 
@@ -43,35 +73,100 @@ func createSQSClient(cfg *viper.Viper, logger *zerolog.Logger) *SQSClient {
 	if endpoint != "" {
 		awsConfig.Endpoint = &endpoint
 	}
+	// The receive count is always requested, it drives retries and poison message handling
+	attributeNames := append(cfg.GetStringSlice("attributeNames"), sqs.MessageSystemAttributeNameApproximateReceiveCount)
+	fifo := strings.HasSuffix(cfg.GetString("url"), ".fifo")
+	if fifo {
+		attributeNames = append(attributeNames, sqs.MessageSystemAttributeNameMessageGroupId, sqs.MessageSystemAttributeNameMessageDeduplicationId)
+	}
+	messageGroupId, err := utils.ParseKeyExpression(cfg.GetString("messageGroupId"))
+	if err != nil {
+		panic(err)
+	}
+	deduplicationId, err := utils.ParseKeyExpression(cfg.GetString("deduplicationId"))
+	if err != nil {
+		panic(err)
+	}
+
 	svc := sqs.New(session.New(), awsConfig)
-	return &SQSClient{
+	client := &SQSClient{
 		*svc,
 		cfg.GetString("url"),
 		cfg.GetInt64("visibilityTimeoutInSeconds"),
 		cfg.GetInt64("maxNumberOfMessages"),
 		cfg.GetBool("unwrapSnsMessage"),
 		logger,
+		cfg.GetInt64("waitTimeSeconds"),
+		cfg.GetInt64("maxReceiveCount"),
+		aws.StringSlice(attributeNames),
+		aws.StringSlice(cfg.GetStringSlice("messageAttributeNames")),
+		fifo,
+		messageGroupId,
+		deduplicationId,
+		&v1.HealthTracker{},
 	}
+	client.health.WithCheck(cfg.GetDuration("healthCheckInterval"), client.checkQueue)
+	return client
+}
+
+// checkQueue verifies the queue exists and is accessible with the client credentials.
+func (c *SQSClient) checkQueue(ctx context.Context) error {
+	_, err := c.sqs.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       &c.url,
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameQueueArn}),
+	})
+	return err
 }
 
 func (m *SQSMessage) Id() string {
 	return *m.MessageId
 }
 
-func (m *SQSMessage) Data() string {
-	if !m.client.unwrapSnsMessage {
-		return *m.Body
+func (m *SQSMessage) Data() []byte {
+	if attr, ok := m.MessageAttributes[bodyEncodingAttribute]; ok && aws.StringValue(attr.StringValue) == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(*m.Body)
+		if err == nil {
+			return decoded
+		}
+		m.client.logger.Warn().Err(err).Str("id", m.Id()).Msg("Failed decoding base64 message, sending along original message instead")
 	}
 
-	var snsMessage SnsMessage
-	err := json.Unmarshal([]byte(*m.Body), &snsMessage)
+	if !m.client.unwrapSnsMessage {
+		return []byte(*m.Body)
+	}
 
+	unwrapped, err := transform.UnwrapSns().Apply(&v1.RawMessage{Data: []byte(*m.Body)})
 	if err != nil {
 		m.client.logger.Warn().Err(err).Str("Body", *m.Body).Msg("Failed deserializing SNS style message, sending along original message instead")
-		return *m.Body
+		return []byte(*m.Body)
 	}
+	return unwrapped.Data
+}
 
-	return snsMessage.Message
+// Metadata returns the message attributes along with the received system attributes, prefixed with sqs-.
+func (m *SQSMessage) Metadata() v1.Metadata {
+	metadata := v1.Metadata{}
+	for k, v := range m.Attributes {
+		switch k {
+		case sqs.MessageSystemAttributeNameApproximateReceiveCount:
+			metadata[v1.MetadataDequeueCount] = aws.StringValue(v)
+		case sqs.MessageSystemAttributeNameSentTimestamp:
+			if ms, err := strconv.ParseInt(aws.StringValue(v), 10, 64); err == nil {
+				metadata[v1.MetadataInsertionTime] = time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+			}
+		case sqs.MessageSystemAttributeNameMessageGroupId:
+			metadata[v1.MetadataGroupId] = aws.StringValue(v)
+		case sqs.MessageSystemAttributeNameMessageDeduplicationId:
+			metadata[v1.MetadataDeduplicationId] = aws.StringValue(v)
+		}
+		metadata[systemAttributePrefix+k] = aws.StringValue(v)
+	}
+	for k, v := range m.MessageAttributes {
+		if k != bodyEncodingAttribute && v.StringValue != nil {
+			metadata[k] = *v.StringValue
+		}
+	}
+	return metadata
 }
 
 func (m *SQSMessage) Complete() error {
@@ -82,8 +177,28 @@ func (m *SQSMessage) Complete() error {
 	return err
 }
 
+// Abort leaves the message to be received again once its visibility timeout expires,
+// it returns false once the message was received maxReceiveCount times.
 func (m *SQSMessage) Abort(error) bool {
-	return true
+	return m.client.maxReceiveCount <= 0 || m.DeliveryCount() < m.client.maxReceiveCount
+}
+
+func (m *SQSMessage) DeliveryCount() int64 {
+	count, _ := strconv.ParseInt(aws.StringValue(m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]), 10, 64)
+	return count
+}
+
+func (m *SQSMessage) ExtendLease() error {
+	return m.Defer(time.Duration(m.client.visibilityTimeoutInSeconds) * time.Second)
+}
+
+func (m *SQSMessage) Defer(delay time.Duration) error {
+	_, err := m.client.sqs.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &m.client.url,
+		ReceiptHandle:     m.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(int64(delay / time.Second)),
+	})
+	return err
 }
 
 func (c *SQSClient) Iter(ctx context.Context, next v1.NextMessage) error {
@@ -96,13 +211,20 @@ Main:
 			break Main
 		default:
 		}
-		messages, err := c.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{
-			QueueUrl:            &c.url,
-			MaxNumberOfMessages: &c.maxNumberOfMessages,
-			VisibilityTimeout:   &c.visibilityTimeoutInSeconds,
+		messages, err := c.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              &c.url,
+			MaxNumberOfMessages:   &c.maxNumberOfMessages,
+			VisibilityTimeout:     &c.visibilityTimeoutInSeconds,
+			WaitTimeSeconds:       &c.waitTimeSeconds,
+			AttributeNames:        c.attributeNames,
+			MessageAttributeNames: c.messageAttributeNames,
 		})
 
 		if err != nil {
+			if ctx.Err() != nil {
+				break Main
+			}
+			c.health.Track(err)
 			c.logger.Debug().Err(err).Msg("Error reading from queue")
 			time.Sleep(errorBackoff.Duration())
 			if errorBackoff.Attempt() >= 10 {
@@ -111,20 +233,20 @@ Main:
 			continue Main
 		}
 		errorBackoff.Reset()
+		c.health.Track(nil)
 
 		if len(messages.Messages) == 0 {
 			c.logger.Debug().Msg("Reached empty queue")
-			time.Sleep(emptyBackoff.Duration())
+			// Long polling already waited for messages
+			if c.waitTimeSeconds == 0 {
+				time.Sleep(emptyBackoff.Duration())
+			}
 			continue Main
 		}
 		emptyBackoff.Reset()
 
+		// Received messages are handled even on shutdown, they would stay invisible until their visibility timeout
 		for _, sqsM := range messages.Messages {
-			select {
-			case <-ctx.Done():
-				break Main
-			default:
-			}
 			message := &SQSMessage{
 				sqsM,
 				c,
@@ -140,22 +262,192 @@ func (c *SQSClient) Produce(context context.Context, m *v1.RawMessage) error {
 		Max: 10 * time.Second,
 		Min: 100 * time.Millisecond,
 	}
+	body, attributes, err := encodeMessage(m)
+	if err != nil {
+		return err
+	}
+	groupId, deduplicationId, err := c.fifoIds(m)
+	if err != nil {
+		return err
+	}
 	act := func() error {
 		_, err := c.sqs.SendMessage(&sqs.SendMessageInput{
-			MessageBody: &m.Data,
-			QueueUrl:    &c.url,
+			MessageBody:            &body,
+			MessageAttributes:      attributes,
+			MessageGroupId:         groupId,
+			MessageDeduplicationId: deduplicationId,
+			QueueUrl:               &c.url,
 		})
 		return err
 	}
-	err := act()
+	err = act()
 	for err != nil {
 		err = act()
 		if backoff.Attempt() > 4 {
-			return err
+			return c.health.Track(err)
 		}
 		time.Sleep(backoff.Duration())
 	}
-	return err
+	return c.health.Track(err)
+}
+
+// ProduceBatch sends the messages in batches of up to 10, a batch that fails as a whole is sent one message at a time.
+func (c *SQSClient) ProduceBatch(ctx context.Context, messages []*v1.RawMessage) []error {
+	errs := make([]error, len(messages))
+	for start := 0; start < len(messages); start += maxBatchSize {
+		chunk := messages[start:min(start+maxBatchSize, len(messages))]
+		var entries []*sqs.SendMessageBatchRequestEntry
+		for i, m := range chunk {
+			body, attributes, err := encodeMessage(m)
+			if err != nil {
+				errs[start+i] = err
+				continue
+			}
+			groupId, deduplicationId, err := c.fifoIds(m)
+			if err != nil {
+				errs[start+i] = err
+				continue
+			}
+			entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+				Id:                     aws.String(strconv.Itoa(start + i)),
+				MessageBody:            aws.String(body),
+				MessageAttributes:      attributes,
+				MessageGroupId:         groupId,
+				MessageDeduplicationId: deduplicationId,
+			})
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		res, err := c.sqs.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+			QueueUrl: &c.url,
+			Entries:  entries,
+		})
+		if c.health.Track(err) != nil {
+			c.logger.Debug().Err(err).Msg("Failed sending batch, sending messages one at a time")
+			for _, entry := range entries {
+				i, _ := strconv.Atoi(aws.StringValue(entry.Id))
+				errs[i] = c.Produce(ctx, messages[i])
+			}
+			continue
+		}
+		for _, failed := range res.Failed {
+			i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+			errs[i] = c.Produce(ctx, messages[i])
+		}
+	}
+	return errs
+}
+
+// CompleteBatch deletes the messages in batches of up to 10.
+func (c *SQSClient) CompleteBatch(messages []v1.Message) []error {
+	errs := make([]error, len(messages))
+	for start := 0; start < len(messages); start += maxBatchSize {
+		chunk := messages[start:min(start+maxBatchSize, len(messages))]
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(chunk))
+		for i, m := range chunk {
+			entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(start + i)),
+				ReceiptHandle: m.(*SQSMessage).ReceiptHandle,
+			}
+		}
+		res, err := c.sqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: &c.url,
+			Entries:  entries,
+		})
+		if err != nil {
+			for i := range chunk {
+				errs[start+i] = err
+			}
+			continue
+		}
+		for _, failed := range res.Failed {
+			i, _ := strconv.Atoi(aws.StringValue(failed.Id))
+			errs[i] = fmt.Errorf("failed deleting message %v: %v", messages[i].Id(), aws.StringValue(failed.Message))
+		}
+	}
+	return errs
+}
+
+// fifoIds returns the message group and deduplication ids of messages sent to fifo queues,
+// the deduplication id defaults to a hash of the message body.
+func (c *SQSClient) fifoIds(m *v1.RawMessage) (*string, *string, error) {
+	if !c.fifo {
+		return nil, nil, nil
+	}
+	groupId, ok := c.messageGroupId.Evaluate("", m.Data, m.Metadata)
+	if !ok || groupId == "" {
+		return nil, nil, fmt.Errorf("missing message group id, expected %v", c.messageGroupId)
+	}
+	deduplicationId, ok := c.deduplicationId.Evaluate("", m.Data, m.Metadata)
+	if !ok || deduplicationId == "" {
+		hash := sha256.Sum256(m.Data)
+		deduplicationId = hex.EncodeToString(hash[:])
+	}
+	return aws.String(groupId), aws.String(deduplicationId), nil
+}
+
+// encodeMessage returns the sqs body and attributes of a message, bodies sqs doesn't accept are base64 encoded.
+func encodeMessage(m *v1.RawMessage) (string, map[string]*sqs.MessageAttributeValue, error) {
+	body, attributes := string(m.Data), messageAttributes(m.Metadata)
+	if !isValidBody(m.Data) {
+		body = base64.StdEncoding.EncodeToString(m.Data)
+		if attributes == nil {
+			attributes = map[string]*sqs.MessageAttributeValue{}
+		}
+		attributes[bodyEncodingAttribute] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String("base64"),
+		}
+	}
+	if len(attributes) > maxMessageAttributes {
+		return "", nil, fmt.Errorf("message has %v attributes, sqs allows up to %v", len(attributes), maxMessageAttributes)
+	}
+	return body, attributes, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// isReceiveMetadata reports metadata that isn't written as message attributes, the fifo ids are sent as message properties.
+func isReceiveMetadata(key string) bool {
+	return v1.IsReceiveMetadata(key) || key == v1.MetadataGroupId || key == v1.MetadataDeduplicationId
+}
+
+// messageAttributes maps the metadata to message attributes, receive metadata isn't written.
+func messageAttributes(metadata v1.Metadata) map[string]*sqs.MessageAttributeValue {
+	if len(metadata) == 0 {
+		return nil
+	}
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for k, v := range metadata {
+		if isReceiveMetadata(k) {
+			continue
+		}
+		attributes[k] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+	return attributes
+}
+
+// isValidBody checks the data against the character set allowed in sqs message bodies.
+func isValidBody(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if r == 0x9 || r == 0xA || r == 0xD || (r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || r >= 0x10000 {
+			continue
+		}
+		return false
+	}
+	return true
 }
 
 type SQSClientFactory struct {
@@ -169,6 +461,6 @@ func (factory *SQSClientFactory) CreateProducer(cfg *viper.Viper, logger *zerolo
 	return createSQSClient(cfg, logger)
 }
 
-func (h *SQSClient) HealthStatus() v1.HealthStatus {
-	return v1.NewHealthStatus(v1.Healthy)
+func (c *SQSClient) HealthStatus() v1.HealthStatus {
+	return c.health.HealthStatus()
 }
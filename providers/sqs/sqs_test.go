@@ -0,0 +1,143 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/rs/zerolog"
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// newTestClient returns a client of a fake sqs endpoint answering every request with the response.
+func newTestClient(t *testing.T, response string) *SQSClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, response)
+	}))
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:                aws.String(server.URL),
+		Region:                  aws.String("us-east-1"),
+		Credentials:             credentials.NewStaticCredentials("id", "secret", ""),
+		DisableComputeChecksums: aws.Bool(true),
+	}))
+	logger := zerolog.Nop()
+	return &SQSClient{
+		sqs:                 *sqs.New(sess),
+		url:                 server.URL + "/queue",
+		maxNumberOfMessages: 10,
+		logger:              &logger,
+		health:              &v1.HealthTracker{},
+	}
+}
+
+const receiveResponse = `<ReceiveMessageResponse><ReceiveMessageResult>
+<Message><MessageId>1</MessageId><ReceiptHandle>r1</ReceiptHandle><Body>a</Body></Message>
+<Message><MessageId>2</MessageId><ReceiptHandle>r2</ReceiptHandle><Body>b</Body></Message>
+<Message><MessageId>3</MessageId><ReceiptHandle>r3</ReceiptHandle><Body>c</Body></Message>
+</ReceiveMessageResult><ResponseMetadata><RequestId>id</RequestId></ResponseMetadata></ReceiveMessageResponse>`
+
+func TestIterPassesReceivedMessagesOnShutdown(t *testing.T) {
+	client := newTestClient(t, receiveResponse)
+	ctx, cancel := context.WithCancel(context.Background())
+	var received []string
+	err := client.Iter(ctx, func(m v1.Message) {
+		received = append(received, m.Id())
+		cancel()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 3 {
+		t.Fatalf("expected every received message to be handled, got %v", received)
+	}
+}
+
+func TestEncodeMessageAttributes(t *testing.T) {
+	metadata := v1.Metadata{
+		v1.MetadataDequeueCount:    "2",
+		v1.MetadataInsertionTime:   "2020-01-01T00:00:00Z",
+		v1.MetadataStatusCode:      "200",
+		v1.MetadataGroupId:         "group",
+		v1.MetadataDeduplicationId: "dedup",
+		"sqs-SentTimestamp":        "1577836800000",
+		"tenant":                   "a",
+	}
+	body, attributes, err := encodeMessage(&v1.RawMessage{Data: []byte(`{"a":1}`), Metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"a":1}` {
+		t.Fatalf("expected valid bodies as is, got %v", body)
+	}
+	if len(attributes) != 1 || aws.StringValue(attributes["tenant"].StringValue) != "a" {
+		t.Fatalf("expected receive metadata and fifo ids not to be written, got %v", attributes)
+	}
+
+	body, attributes, err = encodeMessage(&v1.RawMessage{Data: []byte{0xff, 0x00}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "/wA=" || aws.StringValue(attributes[bodyEncodingAttribute].StringValue) != "base64" {
+		t.Fatalf("expected invalid bodies to be base64 encoded, got %v %v", body, attributes)
+	}
+}
+
+func TestEncodeMessageAttributesLimit(t *testing.T) {
+	metadata := v1.Metadata{v1.MetadataDequeueCount: "1"}
+	for i := 0; i < maxMessageAttributes; i++ {
+		metadata[fmt.Sprintf("key-%v", i)] = "value"
+	}
+	if _, attributes, err := encodeMessage(&v1.RawMessage{Data: []byte("{}"), Metadata: metadata}); err != nil || len(attributes) != maxMessageAttributes {
+		t.Fatalf("expected up to %v attributes to be sent, got %v attributes and %v", maxMessageAttributes, len(attributes), err)
+	}
+	// The body encoding attribute counts towards the limit
+	if _, _, err := encodeMessage(&v1.RawMessage{Data: []byte{0xff}, Metadata: metadata}); err == nil {
+		t.Fatal("expected more than 10 attributes to be rejected")
+	}
+	metadata["one-too-many"] = "value"
+	if _, _, err := encodeMessage(&v1.RawMessage{Data: []byte("{}"), Metadata: metadata}); err == nil {
+		t.Fatal("expected more than 10 attributes to be rejected")
+	}
+}
+
+func TestFifoIds(t *testing.T) {
+	groupId, _ := utils.ParseKeyExpression("metadata." + v1.MetadataGroupId)
+	deduplicationId, _ := utils.ParseKeyExpression("body.id")
+	client := &SQSClient{fifo: true, messageGroupId: groupId, deduplicationId: deduplicationId}
+
+	group, dedup, err := client.fifoIds(&v1.RawMessage{Data: []byte(`{"id":"42"}`), Metadata: v1.Metadata{v1.MetadataGroupId: "group"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(group) != "group" || aws.StringValue(dedup) != "42" {
+		t.Fatalf("expected the ids from the key expressions, got %v %v", aws.StringValue(group), aws.StringValue(dedup))
+	}
+
+	_, first, err := client.fifoIds(&v1.RawMessage{Data: []byte(`{"other":1}`), Metadata: v1.Metadata{v1.MetadataGroupId: "group"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, _ := client.fifoIds(&v1.RawMessage{Data: []byte(`{"other":1}`), Metadata: v1.Metadata{v1.MetadataGroupId: "other"}})
+	if len(aws.StringValue(first)) != 64 || aws.StringValue(first) != aws.StringValue(second) {
+		t.Fatalf("expected the deduplication id to default to the body hash, got %v %v", aws.StringValue(first), aws.StringValue(second))
+	}
+
+	for _, metadata := range []v1.Metadata{{}, {v1.MetadataGroupId: ""}} {
+		if _, _, err := client.fifoIds(&v1.RawMessage{Data: []byte("{}"), Metadata: metadata}); err == nil {
+			t.Fatalf("expected a missing group id to fail, metadata %v", metadata)
+		}
+	}
+
+	client.fifo = false
+	if group, dedup, err := client.fifoIds(&v1.RawMessage{Data: []byte("{}")}); group != nil || dedup != nil || err != nil {
+		t.Fatal("expected standard queues not to get fifo ids")
+	}
+}
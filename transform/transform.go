@@ -0,0 +1,132 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"github.com/soluto/dqd/utils"
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// Step reshapes a message payload, the given message is not modified.
+type Step interface {
+	Apply(m *v1.RawMessage) (*v1.RawMessage, error)
+}
+
+type StepFunc func(m *v1.RawMessage) (*v1.RawMessage, error)
+
+func (f StepFunc) Apply(m *v1.RawMessage) (*v1.RawMessage, error) {
+	return f(m)
+}
+
+// Pipeline applies its steps in order.
+type Pipeline []Step
+
+func (p Pipeline) Apply(m *v1.RawMessage) (*v1.RawMessage, error) {
+	var err error
+	for _, step := range p {
+		if m, err = step.Apply(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Extract replaces the payload with the value at a json path, string values are used as is and other values as json.
+func Extract(path string) Step {
+	return StepFunc(func(m *v1.RawMessage) (*v1.RawMessage, error) {
+		value, ok := utils.JsonPath(m.Data, path)
+		if !ok {
+			return nil, fmt.Errorf("missing json path: %v", path)
+		}
+		return &v1.RawMessage{Data: []byte(utils.JsonString(value)), Metadata: m.Metadata}, nil
+	})
+}
+
+type templateData struct {
+	Body     interface{}
+	Data     string
+	Metadata v1.Metadata
+}
+
+// Template replaces the payload with the executed template. The template gets the parsed json payload as .Body,
+// the raw payload as .Data and the metadata as .Metadata, use the json function to embed values in json documents.
+func Template(text string) (Step, error) {
+	t, err := template.New("transform").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return StepFunc(func(m *v1.RawMessage) (*v1.RawMessage, error) {
+		body, _ := utils.JsonPath(m.Data, "")
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, &templateData{body, string(m.Data), m.Metadata}); err != nil {
+			return nil, err
+		}
+		return &v1.RawMessage{Data: buf.Bytes(), Metadata: m.Metadata}, nil
+	}), nil
+}
+
+func Base64Decode() Step {
+	return StepFunc(func(m *v1.RawMessage) (*v1.RawMessage, error) {
+		data, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(m.Data)))
+		if err != nil {
+			return nil, err
+		}
+		return &v1.RawMessage{Data: data, Metadata: m.Metadata}, nil
+	})
+}
+
+func Base64Encode() Step {
+	return StepFunc(func(m *v1.RawMessage) (*v1.RawMessage, error) {
+		return &v1.RawMessage{Data: []byte(base64.StdEncoding.EncodeToString(m.Data)), Metadata: m.Metadata}, nil
+	})
+}
+
+type snsMessage struct {
+	Message           *string `json:"Message"`
+	MessageAttributes map[string]struct {
+		Type  string `json:"Type"`
+		Value string `json:"Value"`
+	} `json:"MessageAttributes"`
+}
+
+// UnwrapSns replaces an SNS notification with the published message, string attributes are added to the metadata.
+func UnwrapSns() Step {
+	return StepFunc(func(m *v1.RawMessage) (*v1.RawMessage, error) {
+		var notification snsMessage
+		if err := json.Unmarshal(m.Data, &notification); err != nil {
+			return nil, fmt.Errorf("failed deserializing SNS message: %w", err)
+		}
+		if notification.Message == nil {
+			return nil, fmt.Errorf("missing SNS message")
+		}
+		metadata := m.Metadata.Copy()
+		for k, attr := range notification.MessageAttributes {
+			if attr.Type == "String" || attr.Type == "Number" {
+				metadata[k] = attr.Value
+			}
+		}
+		return &v1.RawMessage{Data: []byte(*notification.Message), Metadata: metadata}, nil
+	})
+}
+
+// TrimSerializationInfo removes anything before the first and after the last json bracket, such as the type
+// information .NET clients add when sending serialized objects.
+func TrimSerializationInfo() Step {
+	return StepFunc(func(m *v1.RawMessage) (*v1.RawMessage, error) {
+		start := bytes.IndexAny(m.Data, "{[")
+		end := bytes.LastIndexAny(m.Data, "}]")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("missing json document")
+		}
+		return &v1.RawMessage{Data: m.Data[start : end+1], Metadata: m.Metadata}, nil
+	})
+}
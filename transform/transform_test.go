@@ -0,0 +1,104 @@
+package transform
+
+import (
+	"testing"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func apply(t *testing.T, step Step, data string, metadata v1.Metadata) string {
+	t.Helper()
+	m, err := step.Apply(&v1.RawMessage{Data: []byte(data), Metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(m.Data)
+}
+
+func TestExtract(t *testing.T) {
+	data := `{"detail":{"name":"dqd","tags":["a","b"]}}`
+	if out := apply(t, Extract("detail.name"), data, nil); out != "dqd" {
+		t.Fatalf("expected string values as is, got %v", out)
+	}
+	if out := apply(t, Extract("detail.tags"), data, nil); out != `["a","b"]` {
+		t.Fatalf("expected other values as json, got %v", out)
+	}
+	if _, err := Extract("detail.missing").Apply(&v1.RawMessage{Data: []byte(data)}); err == nil {
+		t.Fatal("expected a missing path to fail")
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	step, err := Template(`{"name":{{json .Body.name}},"source":"{{.Metadata.source}}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := apply(t, step, `{"name":"a \"quoted\" name"}`, v1.Metadata{"source": "sqs"})
+	if out != `{"name":"a \"quoted\" name","source":"sqs"}` {
+		t.Fatalf("unexpected template output %v", out)
+	}
+	step, err = Template(`raw: {{.Data}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := apply(t, step, "not json", nil); out != "raw: not json" {
+		t.Fatalf("expected the raw payload, got %v", out)
+	}
+	if _, err = Template(`{{.Body`); err == nil {
+		t.Fatal("expected an invalid template to be rejected")
+	}
+}
+
+func TestBase64(t *testing.T) {
+	if out := apply(t, Base64Encode(), "hello", nil); out != "aGVsbG8=" {
+		t.Fatalf("unexpected encoding %v", out)
+	}
+	if out := apply(t, Base64Decode(), "aGVsbG8=\n", nil); out != "hello" {
+		t.Fatalf("unexpected decoding %v", out)
+	}
+	if _, err := Base64Decode().Apply(&v1.RawMessage{Data: []byte("not base64!")}); err == nil {
+		t.Fatal("expected invalid base64 to fail")
+	}
+}
+
+func TestUnwrapSns(t *testing.T) {
+	data := `{"Type":"Notification","Message":"{\"id\":1}","MessageAttributes":{
+		"tenant":{"Type":"String","Value":"a"},
+		"count":{"Type":"Number","Value":"3"},
+		"blob":{"Type":"Binary","Value":"AAE="}}}`
+	m, err := UnwrapSns().Apply(&v1.RawMessage{Data: []byte(data), Metadata: v1.Metadata{"source": "sqs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Data) != `{"id":1}` {
+		t.Fatalf("expected the published message, got %v", string(m.Data))
+	}
+	if len(m.Metadata) != 3 || m.Metadata["tenant"] != "a" || m.Metadata["count"] != "3" || m.Metadata["source"] != "sqs" {
+		t.Fatalf("expected string and number attributes in the metadata, got %v", m.Metadata)
+	}
+	for _, invalid := range []string{"not json", `{"Type":"Notification"}`} {
+		if _, err := UnwrapSns().Apply(&v1.RawMessage{Data: []byte(invalid)}); err == nil {
+			t.Fatalf("expected %v to fail", invalid)
+		}
+	}
+}
+
+func TestTrimSerializationInfo(t *testing.T) {
+	if out := apply(t, TrimSerializationInfo(), "@\x06string\x083http://schemas.microsoft.com/{\"a\":[1]}\x01", nil); out != `{"a":[1]}` {
+		t.Fatalf("expected the json document, got %q", out)
+	}
+	if out := apply(t, TrimSerializationInfo(), `[1,2]`, nil); out != `[1,2]` {
+		t.Fatalf("expected json to be kept, got %q", out)
+	}
+	if _, err := TrimSerializationInfo().Apply(&v1.RawMessage{Data: []byte("no json")}); err == nil {
+		t.Fatal("expected a payload without json to fail")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	pipeline := Pipeline{UnwrapSns(), Base64Decode(), Extract("name")}
+	out := apply(t, pipeline, `{"Message":"eyJuYW1lIjoiZHFkIn0="}`, nil)
+	if out != "dqd" {
+		t.Fatalf("expected the steps to be applied in order, got %v", out)
+	}
+}
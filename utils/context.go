@@ -7,15 +7,17 @@ import (
 	"syscall"
 )
 
+// ContextWithSignal cancels the context on the first signal and exits on the second one.
 func ContextWithSignal(ctx context.Context) context.Context {
 	newCtx, cancel := context.WithCancel(ctx)
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		select {
-		case <-signals:
-			cancel()
-		}
+		<-signals
+		cancel()
+		<-signals
+		logger.Warn().Msg("Forced shutdown")
+		os.Exit(1)
 	}()
 	return newCtx
 }
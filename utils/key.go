@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+// KeyExpression selects a value of a message, used for message groups, deduplication and aggregation keys.
+// Supported expressions are "id", "metadata.<key>" and "body.<json path>".
+type KeyExpression struct {
+	kind string
+	path string
+}
+
+func ParseKeyExpression(expr string) (*KeyExpression, error) {
+	kind, path := expr, ""
+	if i := strings.Index(expr, "."); i >= 0 {
+		kind, path = expr[:i], expr[i+1:]
+	}
+	switch {
+	case kind == "id" && path == "":
+	case kind == "metadata" && path != "":
+	case kind == "body":
+	default:
+		return nil, fmt.Errorf("invalid key expression: %v", expr)
+	}
+	return &KeyExpression{kind, path}, nil
+}
+
+// Evaluate returns the key of a message, false when the message doesn't have it.
+func (e *KeyExpression) Evaluate(id string, data []byte, metadata v1.Metadata) (string, bool) {
+	switch e.kind {
+	case "id":
+		return id, id != ""
+	case "metadata":
+		value, ok := metadata[e.path]
+		return value, ok
+	default:
+		value, ok := JsonPath(data, e.path)
+		if !ok || value == nil {
+			return "", false
+		}
+		return JsonString(value), true
+	}
+}
+
+func (e *KeyExpression) String() string {
+	if e.path == "" {
+		return e.kind
+	}
+	return e.kind + "." + e.path
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"testing"
+
+	v1 "github.com/soluto/dqd/v1"
+)
+
+func TestParseKeyExpression(t *testing.T) {
+	for _, expr := range []string{"id", "metadata.group-id", "body", "body.a.b"} {
+		e, err := ParseKeyExpression(expr)
+		if err != nil {
+			t.Fatalf("ParseKeyExpression(%q) failed: %v", expr, err)
+		}
+		if e.String() != expr {
+			t.Fatalf("expected %q, got %q", expr, e.String())
+		}
+	}
+	for _, expr := range []string{"", "id.x", "metadata", "header.x"} {
+		if _, err := ParseKeyExpression(expr); err == nil {
+			t.Fatalf("expected ParseKeyExpression(%q) to fail", expr)
+		}
+	}
+}
+
+func TestKeyExpressionEvaluate(t *testing.T) {
+	data := []byte(`{"user":{"id":42,"name":"a"},"items":[{"sku":"x"}],"empty":null,"flag":true}`)
+	metadata := v1.Metadata{"group-id": "g"}
+	tests := []struct {
+		expr   string
+		value  string
+		exists bool
+	}{
+		{"id", "m1", true},
+		{"metadata.group-id", "g", true},
+		{"metadata.missing", "", false},
+		{"body.user.id", "42", true},
+		{"body.user.name", "a", true},
+		{"body.user", `{"id":42,"name":"a"}`, true},
+		{"body.items.0.sku", "x", true},
+		{"body.items.1.sku", "", false},
+		{"body.flag", "true", true},
+		{"body.empty", "", false},
+		{"body.missing", "", false},
+	}
+	for _, test := range tests {
+		e, err := ParseKeyExpression(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, exists := e.Evaluate("m1", data, metadata)
+		if value != test.value || exists != test.exists {
+			t.Errorf("%v: expected (%q, %v), got (%q, %v)", test.expr, test.value, test.exists, value, exists)
+		}
+	}
+
+	id, _ := ParseKeyExpression("id")
+	if _, exists := id.Evaluate("", data, metadata); exists {
+		t.Error("expected an empty id not to exist")
+	}
+	body, _ := ParseKeyExpression("body.a")
+	if _, exists := body.Evaluate("m1", []byte("not json"), metadata); exists {
+		t.Error("expected invalid json not to have keys")
+	}
+}
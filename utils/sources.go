@@ -10,19 +10,20 @@ import (
 )
 
 type ioClient struct {
-	file *os.File
+	file   *os.File
+	health v1.HealthTracker
 }
 
 type IoSourceFactory struct {
 }
 
 func (c *ioClient) HealthStatus() v1.HealthStatus {
-	return v1.NewHealthStatus(v1.Healthy)
+	return c.health.HealthStatus()
 }
 
 func (c *ioClient) Produce(context context.Context, m *v1.RawMessage) error {
-	_, err := c.file.WriteString(m.Data)
-	return err
+	_, err := c.file.Write(m.Data)
+	return c.health.Track(err)
 }
 
 func (*IoSourceFactory) CreateConsumer(config *viper.Viper, logger *zerolog.Logger) v1.Consumer {
@@ -39,6 +40,6 @@ func (*IoSourceFactory) CreateProducer(config *viper.Viper, logger *zerolog.Logg
 	}
 
 	return &ioClient{
-		file,
+		file: file,
 	}
 }
@@ -2,6 +2,7 @@ package v1
 
 import (
 	"context"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -11,21 +12,55 @@ import (
 type NextMessage func(Message)
 
 type RawMessage struct {
-	Data string
+	Data     []byte   `json:"data"`
+	Metadata Metadata `json:"metadata,omitempty"`
 }
 
 type Message interface {
 	Id() string
-	Data() string
+	Data() []byte
+	Metadata() Metadata
 	Complete() error
 	Abort(error) bool
 }
 
+// DeliveryCounter is implemented by messages that know how many times they were delivered.
+type DeliveryCounter interface {
+	DeliveryCount() int64
+}
+
+// LeaseExtender is implemented by messages whose visibility or lock can be extended while they are handled.
+type LeaseExtender interface {
+	ExtendLease() error
+}
+
+// Deferrer is implemented by messages that can be redelivered after a delay.
+type Deferrer interface {
+	Defer(delay time.Duration) error
+}
+
+// InvalidMessage is implemented by messages that may have been received in a form that can't be read, such messages
+// are handled as failed without calling the handler.
+type InvalidMessage interface {
+	Invalid() error
+}
+
+// DeadLetterer is implemented by messages that can be moved to a provider dead letter queue.
+type DeadLetterer interface {
+	DeadLetter(reason error) error
+}
+
 type Consumer interface {
 	HealthChecker
 	Iter(ctx context.Context, next NextMessage) error
 }
 
+// ConsumerCloser is implemented by consumers that keep resources needed to settle received messages,
+// it is called once the in flight messages were drained.
+type ConsumerCloser interface {
+	Close() error
+}
+
 type ConsumerFactory interface {
 	CreateConsumer(config *viper.Viper, logger *zerolog.Logger) Consumer
 }
@@ -35,6 +70,18 @@ type Producer interface {
 	Produce(context context.Context, m *RawMessage) error
 }
 
+// BatchCompleter is implemented by consumers that can complete several of their messages in a single call.
+// Errors are returned by message index, nil for completed messages.
+type BatchCompleter interface {
+	CompleteBatch(messages []Message) []error
+}
+
+// BatchProducer is implemented by producers that can send several messages in a single call.
+// Errors are returned by message index, nil for sent messages.
+type BatchProducer interface {
+	ProduceBatch(ctx context.Context, messages []*RawMessage) []error
+}
+
 type ProducerFactory interface {
 	CreateProducer(config *viper.Viper, logger *zerolog.Logger) Producer
 }
@@ -0,0 +1,45 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Envelope wraps a failed message with its failure context.
+type Envelope struct {
+	Error         string      `json:"error"`
+	Code          int         `json:"code,omitempty"`
+	Pipe          string      `json:"pipe"`
+	Source        string      `json:"source"`
+	MessageId     string      `json:"messageId"`
+	Attempts      int         `json:"attempts"`
+	DeliveryCount int64       `json:"deliveryCount,omitempty"`
+	DequeuedAt    time.Time   `json:"dequeuedAt"`
+	FailedAt      time.Time   `json:"failedAt"`
+	Message       *RawMessage `json:"message"`
+}
+
+func (e *Envelope) Wrap() (*RawMessage, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return &RawMessage{
+		Data: data,
+		Metadata: Metadata{
+			MetadataContentType: "application/json",
+		},
+	}, nil
+}
+
+func UnwrapEnvelope(data []byte) (*RawMessage, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if e.Message == nil {
+		return nil, fmt.Errorf("missing envelope message")
+	}
+	return e.Message, nil
+}
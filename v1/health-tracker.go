@@ -0,0 +1,83 @@
+package v1
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HealthTracker tracks the health of a provider from the outcome of its operations,
+// it is unhealthy while the last operation failed.
+// An optional active check is run when the status is read, at most once every check interval.
+type HealthTracker struct {
+	lock          sync.Mutex
+	lastSuccess   time.Time
+	lastError     time.Time
+	err           error
+	check         func(ctx context.Context) error
+	checkInterval time.Duration
+	lastCheck     time.Time
+	checkErr      error
+}
+
+const healthCheckTimeout = 10 * time.Second
+
+// WithCheck sets the active check of the tracker, a zero interval disables it.
+func (t *HealthTracker) WithCheck(interval time.Duration, check func(ctx context.Context) error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if interval > 0 {
+		t.check = check
+		t.checkInterval = interval
+	}
+}
+
+// Track records the outcome of an operation and returns its error.
+func (t *HealthTracker) Track(err error) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err != nil {
+		t.lastError = time.Now()
+		t.err = err
+	} else {
+		t.lastSuccess = time.Now()
+	}
+	return err
+}
+
+func (t *HealthTracker) runCheck() error {
+	t.lock.Lock()
+	check := t.check
+	due := check != nil && time.Since(t.lastCheck) >= t.checkInterval
+	t.lock.Unlock()
+	if !due {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	err := check(ctx)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastCheck = time.Now()
+	t.checkErr = err
+	return err
+}
+
+func (t *HealthTracker) HealthStatus() HealthStatus {
+	t.runCheck()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	status := NewHealthStatus(Healthy)
+	if t.err != nil && t.lastError.After(t.lastSuccess) {
+		status[""] = Error(t.err)
+	}
+	if t.check != nil {
+		status["check"] = Healthy
+		if t.checkErr != nil {
+			status["check"] = Error(t.checkErr)
+		}
+	}
+	return status
+}
@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthTrackerTracksLastOperation(t *testing.T) {
+	tracker := &HealthTracker{}
+	if !tracker.HealthStatus().IsHealthy() {
+		t.Fatal("expected a new tracker to be healthy")
+	}
+	err := errors.New("connection refused")
+	if tracked := tracker.Track(err); tracked != err {
+		t.Fatalf("expected the error to be returned, got %v", tracked)
+	}
+	if status := tracker.HealthStatus(); status[""] != Error(err) {
+		t.Fatalf("expected the failure to be reported, got %v", status)
+	}
+	time.Sleep(time.Millisecond)
+	tracker.Track(nil)
+	if status := tracker.HealthStatus(); !status.IsHealthy() {
+		t.Fatalf("expected a later success to be healthy, got %v", status)
+	}
+}
+
+func TestHealthTrackerCheck(t *testing.T) {
+	tracker := &HealthTracker{}
+	calls := 0
+	var checkErr error
+	tracker.WithCheck(50*time.Millisecond, func(ctx context.Context) error {
+		calls++
+		return checkErr
+	})
+	if status := tracker.HealthStatus(); !status.IsHealthy() || status["check"] != Healthy {
+		t.Fatalf("expected the check status to be reported, got %v", status)
+	}
+	checkErr = errors.New("queue not found")
+	if status := tracker.HealthStatus(); !status.IsHealthy() || calls != 1 {
+		t.Fatalf("expected the check to run at most once per interval, got %v calls", calls)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if status := tracker.HealthStatus(); status["check"] != Error(checkErr) || calls != 2 {
+		t.Fatalf("expected the check to run again after the interval, got %v and %v calls", status, calls)
+	}
+}
+
+func TestHealthTrackerWithoutCheckInterval(t *testing.T) {
+	tracker := &HealthTracker{}
+	tracker.WithCheck(0, func(ctx context.Context) error {
+		t.Fatal("expected a zero interval to disable the check")
+		return nil
+	})
+	if status := tracker.HealthStatus(); len(status) != 1 || !status.IsHealthy() {
+		t.Fatalf("expected only the operations status, got %v", status)
+	}
+}
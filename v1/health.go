@@ -37,6 +37,13 @@ func (h HealthStatus) Add(h2 HealthStatus, prefix string) HealthStatus {
 	return h
 }
 
+// HealthCheckerFunc adapts a function to a HealthChecker.
+type HealthCheckerFunc func() HealthStatus
+
+func (f HealthCheckerFunc) HealthStatus() HealthStatus {
+	return f()
+}
+
 type CompositeHealthChecker struct {
 	checkers map[string]HealthChecker
 }
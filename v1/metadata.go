@@ -0,0 +1,86 @@
+package v1
+
+import (
+	"net/http"
+	"strings"
+)
+
+// MetadataHeaderPrefix is the http header prefix used to carry message metadata.
+const MetadataHeaderPrefix = "X-Dqd-Meta-"
+
+// Well known metadata keys filled by providers.
+const (
+	MetadataContentType     = "content-type"
+	MetadataContentEncoding = "content-encoding"
+	MetadataCorrelationId   = "correlation-id"
+	MetadataDequeueCount    = "dequeue-count"
+	MetadataInsertionTime   = "insertion-time"
+	MetadataExpirationTime  = "expiration-time"
+	MetadataStatusCode      = "status-code"
+	MetadataGroupId         = "group-id"
+	MetadataDeduplicationId = "deduplication-id"
+)
+
+// MetadataSqsAttributePrefix prefixes the metadata keys of sqs system attributes.
+const MetadataSqsAttributePrefix = "sqs-"
+
+type Metadata map[string]string
+
+// IsReceiveMetadata reports metadata describing a delivery or a handler reply, producers don't write it since
+// it is stale once the message is sent again.
+func IsReceiveMetadata(key string) bool {
+	switch key {
+	case MetadataDequeueCount, MetadataInsertionTime, MetadataExpirationTime, MetadataStatusCode:
+		return true
+	}
+	return strings.HasPrefix(key, MetadataSqsAttributePrefix)
+}
+
+func (m Metadata) Copy() Metadata {
+	c := Metadata{}
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func (m Metadata) ContentType() string {
+	return m[MetadataContentType]
+}
+
+func (m Metadata) ContentEncoding() string {
+	return m[MetadataContentEncoding]
+}
+
+// Headers returns the metadata as http headers, content type and encoding are mapped to their standard headers.
+func (m Metadata) Headers() map[string]string {
+	h := map[string]string{}
+	for k, v := range m {
+		switch k {
+		case MetadataContentType:
+			h["Content-Type"] = v
+		case MetadataContentEncoding:
+			h["Content-Encoding"] = v
+		default:
+			h[MetadataHeaderPrefix+k] = v
+		}
+	}
+	return h
+}
+
+func MetadataFromHeaders(h http.Header) Metadata {
+	m := Metadata{}
+	for k, v := range h {
+		if len(v) == 0 || !strings.HasPrefix(http.CanonicalHeaderKey(k), MetadataHeaderPrefix) {
+			continue
+		}
+		m[strings.ToLower(k[len(MetadataHeaderPrefix):])] = v[0]
+	}
+	if contentType := h.Get("Content-Type"); contentType != "" {
+		m[MetadataContentType] = contentType
+	}
+	if contentEncoding := h.Get("Content-Encoding"); contentEncoding != "" {
+		m[MetadataContentEncoding] = contentEncoding
+	}
+	return m
+}
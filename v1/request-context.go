@@ -12,10 +12,12 @@ func (c contextKey) String() string {
 }
 
 var (
-	ContextKeyMessage = contextKey("message")
-	ContextKeyResult  = contextKey("result")
-	ContextKeySource  = contextKey("source")
-	ContextKeyStart   = contextKey("start")
+	ContextKeyMessage  = contextKey("message")
+	ContextKeyPayload  = contextKey("payload")
+	ContextKeyResult   = contextKey("result")
+	ContextKeySource   = contextKey("source")
+	ContextKeyStart    = contextKey("start")
+	ContextKeyAttempts = contextKey("attempts")
 )
 
 type RequestContext struct {
@@ -46,6 +48,27 @@ func (r *RequestContext) Message() Message {
 	return m
 }
 
+// Request returns the message passed to the handler, acknowledgements should still use Message.
+func (r *RequestContext) Request() Message {
+	if p, ok := r.Value(ContextKeyPayload).(*RawMessage); ok {
+		return &PayloadMessage{r.Message(), p}
+	}
+	return r.Message()
+}
+
+func (r *RequestContext) WithPayload(p *RawMessage) *RequestContext {
+	return &RequestContext{context.WithValue(r.Context, ContextKeyPayload, p)}
+}
+
+func (r *RequestContext) Attempts() int {
+	a, _ := r.Value(ContextKeyAttempts).(int)
+	return a
+}
+
+func (r *RequestContext) WithAttempts(attempts int) *RequestContext {
+	return &RequestContext{context.WithValue(r.Context, ContextKeyAttempts, attempts)}
+}
+
 func (r *RequestContext) Source() string {
 	s, _ := r.Value(ContextKeySource).(string)
 	return s
@@ -77,3 +100,17 @@ func (r *RequestContext) Result() (m *RawMessage, err error) {
 	}
 	return nil, nil
 }
+
+// PayloadMessage is a message with a replaced payload, acknowledgements use the original message.
+type PayloadMessage struct {
+	Message
+	Payload *RawMessage
+}
+
+func (m *PayloadMessage) Data() []byte {
+	return m.Payload.Data
+}
+
+func (m *PayloadMessage) Metadata() Metadata {
+	return m.Payload.Metadata
+}